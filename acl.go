@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// An ACLAction is what an ACL does with requests from a client.
+type ACLAction int
+
+const (
+	// ACLAllow passes requests on to the wrapped Handler.
+	ACLAllow ACLAction = iota
+	// ACLDeny drops requests without reply.
+	ACLDeny
+	// ACLRefuse replies to requests with a Refused message.
+	ACLRefuse
+)
+
+var aclActionNames = []string{"allow", "deny", "refuse"}
+
+func (a ACLAction) String() string {
+	if a >= 0 && int(a) < len(aclActionNames) {
+		return aclActionNames[a]
+	}
+	return fmt.Sprintf("ACLAction(%d)", int(a))
+}
+
+// ParseACLAction returns the action named s: allow, deny or refuse.
+func ParseACLAction(s string) (ACLAction, error) {
+	for i, name := range aclActionNames {
+		if s == name {
+			return ACLAction(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown acl action %q", s)
+}
+
+// An ACLRule applies Action to requests from clients in Net.
+type ACLRule struct {
+	Net    *net.IPNet
+	Action ACLAction
+}
+
+// An ACL controls which clients may use a Handler. The rule with the
+// most specific network containing the client's address applies; of
+// equally specific rules, the last applies, so rules appended to an
+// ACL override those before them. Requests from clients matching no
+// rule, or whose address is unknown, are refused.
+type ACL []ACLRule
+
+// DefaultACL allows clients on the loopback and private networks.
+var DefaultACL = ACL{
+	{Net: mustParseCIDR("127.0.0.0/8")},
+	{Net: mustParseCIDR("10.0.0.0/8")},
+	{Net: mustParseCIDR("172.16.0.0/12")},
+	{Net: mustParseCIDR("192.168.0.0/16")},
+	{Net: mustParseCIDR("169.254.0.0/16")},
+	{Net: mustParseCIDR("::1/128")},
+	{Net: mustParseCIDR("fc00::/7")},
+	{Net: mustParseCIDR("fe80::/10")},
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Action returns the action applied to requests from ip.
+func (acl ACL) Action(ip net.IP) ACLAction {
+	action, best := ACLRefuse, -1
+	if ip == nil {
+		return action
+	}
+	for _, rule := range acl {
+		if rule.Net == nil || !rule.Net.Contains(ip) {
+			continue
+		}
+		if ones, _ := rule.Net.Mask.Size(); ones >= best {
+			action, best = rule.Action, ones
+		}
+	}
+	return action
+}
+
+// Handler returns a Handler applying acl to each request before
+// passing those allowed to h. The client's address is found using the
+// RemoteAddr method of the ResponseWriter, as provided by Server.
+func (acl ACL) Handler(h Handler) Handler {
+	return func(w ResponseWriter, msg *dnsmessage.Message) {
+		switch acl.Action(remoteIP(w)) {
+		case ACLAllow:
+			h(w, msg)
+		case ACLDeny:
+		default:
+			Refuse(w, msg)
+		}
+	}
+}
+
+// remoteIP returns the address of the client answered by w, or nil if
+// it is unknown.
+func remoteIP(w ResponseWriter) net.IP {
+	ra, ok := w.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return nil
+	}
+	return addrIP(ra.RemoteAddr())
+}
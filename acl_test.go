@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestACLAction(t *testing.T) {
+	acl := append(ACL{}, DefaultACL...)
+	acl = append(acl,
+		ACLRule{Net: mustParseCIDR("10.1.0.0/16"), Action: ACLDeny},
+		ACLRule{Net: mustParseCIDR("10.1.2.0/24"), Action: ACLAllow},
+		ACLRule{Net: mustParseCIDR("192.168.0.0/16"), Action: ACLRefuse},
+		ACLRule{Net: mustParseCIDR("2001:db8::/32"), Action: ACLAllow},
+	)
+	tests := map[string]ACLAction{
+		"127.0.0.1":       ACLAllow,
+		"::1":             ACLAllow,
+		"10.9.9.9":        ACLAllow,
+		"10.1.9.9":        ACLDeny,
+		"10.1.2.3":        ACLAllow,
+		"192.168.1.1":     ACLRefuse, // later rule for the same network
+		"192.0.2.1":       ACLRefuse, // no rule
+		"2001:db8::1":     ACLAllow,
+		"2001:db9::1":     ACLRefuse,
+		"::ffff:10.1.9.9": ACLDeny,
+	}
+	for addr, want := range tests {
+		if got := acl.Action(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: got action %s, want %s", addr, got, want)
+		}
+	}
+	if got := acl.Action(nil); got != ACLRefuse {
+		t.Errorf("unknown address: got action %s, want %s", got, ACLRefuse)
+	}
+}
+
+// aclWriter records the messages written in reply to a client at raddr.
+type aclWriter struct {
+	raddr net.Addr
+	msgs  []dnsmessage.Message
+}
+
+func (w *aclWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *aclWriter) WriteMsg(msg dnsmessage.Message) error {
+	w.msgs = append(w.msgs, msg)
+	return nil
+}
+
+func (w *aclWriter) RemoteAddr() net.Addr { return w.raddr }
+
+func TestACLHandler(t *testing.T) {
+	acl := ACL{
+		{Net: mustParseCIDR("192.0.2.0/24"), Action: ACLAllow},
+		{Net: mustParseCIDR("198.51.100.0/24"), Action: ACLDeny},
+	}
+	var handled bool
+	h := acl.Handler(func(w ResponseWriter, msg *dnsmessage.Message) {
+		handled = true
+	})
+	qmsg := &dnsmessage.Message{Questions: []dnsmessage.Question{testq}}
+
+	tests := []struct {
+		addr    string
+		handled bool
+		replies int
+	}{
+		{"192.0.2.1", true, 0},
+		{"198.51.100.1", false, 0},
+		{"203.0.113.1", false, 1},
+	}
+	for _, tt := range tests {
+		handled = false
+		w := &aclWriter{raddr: &net.UDPAddr{IP: net.ParseIP(tt.addr), Port: 5353}}
+		h(w, qmsg)
+		if handled != tt.handled || len(w.msgs) != tt.replies {
+			t.Errorf("%s: handled %v with %d replies, want %v with %d", tt.addr, handled, len(w.msgs), tt.handled, tt.replies)
+		}
+		if len(w.msgs) > 0 && w.msgs[0].Header.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("%s: got rcode %s", tt.addr, w.msgs[0].Header.RCode)
+		}
+	}
+}
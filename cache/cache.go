@@ -0,0 +1,528 @@
+/*
+Package cache provides a concurrency-safe cache of DNS answers
+for use by resolvers and forwarding servers.
+
+Answers are stored by question for as long as their TTLs allow.
+Negative answers (NXDOMAIN and NODATA) are cached as described in RFC 2308,
+for the lesser of the TTL and minimum TTL of the SOA record in the
+authority section. NXDOMAIN answers apply to every type of the name
+in question.
+
+Expired answers may be kept for a while longer and returned by GetStale,
+so that resolvers can answer with stale data when authoritative servers
+are unreachable (RFC 8767).
+
+Answers are ranked by credibility, from data found in the additional
+section of a response up to authoritative answers, as in RFC 2181
+section 5.4.1. An answer does not replace a cached answer to the same
+question of higher credibility until the latter expires, so that
+glue, for example, cannot overwrite authoritative data.
+
+Popular answers may be refreshed shortly before they expire by setting
+Prefetch, so that they are always answered from the cache.
+
+A Cache is bounded by a number of entries or an estimate of the memory
+used by entries, and evicts the least recently used entries to stay
+within its limits. Entries are spread across a number of shards,
+each with its own lock, so that lookups of different names rarely
+contend with each other.
+
+	c := &cache.Cache{MaxEntries: 10000, MaxTTL: 24 * time.Hour}
+	if rmsg, ok := c.Get(q); ok {
+		// answer from cache
+	}
+	rmsg, err := dns.Ask(q, addr)
+	if err == nil {
+		c.Put(q, rmsg)
+	}
+*/
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// nshards is the number of independently locked shards of a Cache.
+const nshards = 16
+
+// staleAnswerTTL is the TTL of resources in stale answers,
+// as recommended by RFC 8767 section 4.
+const staleAnswerTTL = 30
+
+// typeNXDomain is the reserved type 0, under which NXDOMAIN answers
+// are stored as they apply to all types of a name.
+const typeNXDomain dnsmessage.Type = 0
+
+// Credibility ranks how far cached data may be trusted by the section
+// and kind of response in which it was found (RFC 2181 section 5.4.1).
+// Greater values are more credible.
+type Credibility int
+
+const (
+	CredAdditional    Credibility = iota // additional section, including glue
+	CredAuthority                        // authority section of a non-authoritative answer, such as a referral
+	CredAnswer                           // answer section of a non-authoritative answer
+	CredAuthAuthority                    // authority section of an authoritative answer
+	CredAuthAnswer                       // answer section of an authoritative answer
+)
+
+// A Cache stores DNS answers until their TTLs expire.
+// The zero value is an empty, unbounded cache ready to use.
+// Limits should be set before the first call to Put.
+type Cache struct {
+	// counters first for 64-bit alignment on 32-bit platforms.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	stale     uint64
+	prefetch  uint64
+
+	// MaxEntries is the maximum number of answers stored.
+	// If zero, there is no limit on the number of entries.
+	MaxEntries int
+	// MaxBytes is the approximate limit on the memory used by stored
+	// answers. If zero, there is no limit on memory.
+	MaxBytes int
+
+	// MinTTL and MaxTTL bound how long answers are stored,
+	// regardless of their TTLs. MaxNegativeTTL bounds how long
+	// negative answers are stored; RFC 2308 section 5 suggests
+	// between one and three hours. If zero, there is no bound.
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	MaxNegativeTTL time.Duration
+	// StaleTTL is how long answers are kept after they expire,
+	// to be returned by GetStale when fresh answers cannot be
+	// found (RFC 8767). If zero, expired answers are removed.
+	StaleTTL time.Duration
+
+	// Prefetch, if not nil, is called in a new goroutine to refresh
+	// popular answers before they expire. It is called when an answer
+	// which has been returned by Get at least PrefetchHits times is
+	// requested again within the last tenth of its TTL. Prefetch should
+	// resolve q afresh and Put the new answer.
+	Prefetch     func(q dnsmessage.Question)
+	PrefetchHits int
+
+	once   sync.Once
+	shards [nshards]shard
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+}
+
+type shard struct {
+	mu    sync.Mutex
+	m     map[key]*list.Element
+	lru   *list.List // front is most recently used
+	bytes int
+}
+
+type key struct {
+	name string // lowercase
+	t    dnsmessage.Type
+	c    dnsmessage.Class
+}
+
+type entry struct {
+	key     key
+	msg     dnsmessage.Message
+	cred    Credibility
+	stored  time.Time
+	expires time.Time
+	size    int
+	// hits counts the times the entry has been returned by Get.
+	hits int
+	// prefetching is set once the entry is being refreshed.
+	prefetching bool
+}
+
+// Stats holds counters of a Cache's activity.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	// Evictions counts entries removed to make room for others.
+	// Expired entries are not counted.
+	Evictions uint64
+	// StaleHits counts expired answers returned by GetStale.
+	StaleHits uint64
+	// Prefetches counts calls to Prefetch.
+	Prefetches uint64
+	Entries    int
+	Bytes      int
+}
+
+func (c *Cache) init() {
+	c.once.Do(func() {
+		for i := range c.shards {
+			c.shards[i].m = make(map[key]*list.Element)
+			c.shards[i].lru = list.New()
+		}
+		if c.now == nil {
+			c.now = time.Now
+		}
+	})
+}
+
+func newKey(name dnsmessage.Name, t dnsmessage.Type, class dnsmessage.Class) key {
+	return key{strings.ToLower(name.String()), t, class}
+}
+
+func (c *Cache) shard(k key) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k.name))
+	return &c.shards[h.Sum32()%nshards]
+}
+
+// Get returns the stored answer to q. The TTL of each resource is set
+// to the time remaining until the answer expires. A cached NXDOMAIN
+// answer for the name in q is returned for any type.
+func (c *Cache) Get(q dnsmessage.Question) (dnsmessage.Message, bool) {
+	return c.get(q, CredAdditional, false)
+}
+
+// GetCredible is like Get, but only returns answers stored with at
+// least the credibility cred. RFC 2181 section 5.4.1 recommends that
+// data from the additional section and referrals is never returned as
+// an answer to a query.
+func (c *Cache) GetCredible(q dnsmessage.Question, cred Credibility) (dnsmessage.Message, bool) {
+	return c.get(q, cred, false)
+}
+
+// GetStale is like Get, but also returns answers which have expired
+// within the last StaleTTL. The TTL of each resource in an expired
+// answer is 30 seconds, as recommended by RFC 8767. Only answers of
+// at least CredAnswer are returned; glue and referrals are never
+// served stale.
+func (c *Cache) GetStale(q dnsmessage.Question) (dnsmessage.Message, bool) {
+	return c.get(q, CredAnswer, true)
+}
+
+func (c *Cache) get(q dnsmessage.Question, cred Credibility, stale bool) (dnsmessage.Message, bool) {
+	c.init()
+	now := c.now()
+	for _, k := range []key{newKey(q.Name, q.Type, q.Class), newKey(q.Name, typeNXDomain, q.Class)} {
+		e, ok := c.shard(k).get(k, now, c.StaleTTL, stale)
+		if !ok || e.cred < cred {
+			continue
+		}
+		if now.Before(e.expires) {
+			atomic.AddUint64(&c.hits, 1)
+			if c.shouldPrefetch(k, e, now) {
+				atomic.AddUint64(&c.prefetch, 1)
+				go c.Prefetch(q)
+			}
+			return e.answer(q, uint32(e.expires.Sub(now)/time.Second)), true
+		}
+		atomic.AddUint64(&c.stale, 1)
+		return e.answer(q, staleAnswerTTL), true
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return dnsmessage.Message{}, false
+}
+
+// get returns the entry for k. Expired entries are only returned if
+// stale is true and they expired within staleTTL; older entries are
+// removed.
+func (s *shard) get(k key, now time.Time, staleTTL time.Duration, stale bool) (*entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.m[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expires.Add(staleTTL)) {
+		s.remove(el)
+		return nil, false
+	}
+	if !now.Before(e.expires) && !stale {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return e, true
+}
+
+// shouldPrefetch reports whether the entry e for k, just returned by
+// get, should be refreshed by a call to Prefetch. Only one refresh of
+// an entry is started.
+func (c *Cache) shouldPrefetch(k key, e *entry, now time.Time) bool {
+	if c.Prefetch == nil {
+		return false
+	}
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.hits++
+	if e.prefetching || e.hits <= c.PrefetchHits {
+		return false
+	}
+	window := e.expires.Sub(e.stored) / 10
+	if now.Before(e.expires.Add(-window)) {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// Put stores rmsg as the answer to q. Only answers with the
+// RCode success or NXDOMAIN which are not truncated are stored.
+// Answers with no resources are stored as NODATA answers.
+// Negative answers without a SOA record in the authority section
+// are not stored, as they have no TTL.
+// The answer's credibility is CredAuthAnswer if rmsg is authoritative,
+// otherwise CredAnswer.
+func (c *Cache) Put(q dnsmessage.Question, rmsg dnsmessage.Message) {
+	cred := CredAnswer
+	if rmsg.Header.Authoritative {
+		cred = CredAuthAnswer
+	}
+	c.PutCredibility(q, rmsg, cred)
+}
+
+// PutCredibility is like Put, but stores rmsg with the given
+// credibility. The answer is not stored if an unexpired answer to q
+// of greater credibility is already stored.
+func (c *Cache) PutCredibility(q dnsmessage.Question, rmsg dnsmessage.Message, cred Credibility) {
+	c.init()
+	if rmsg.Header.Truncated {
+		return
+	}
+	k := newKey(q.Name, q.Type, q.Class)
+	var ttl time.Duration
+	switch {
+	case rmsg.Header.RCode == dnsmessage.RCodeNameError:
+		// the name in question may exist if we followed a CNAME.
+		if len(rmsg.Answers) == 0 {
+			k.t = typeNXDomain
+		}
+		fallthrough
+	case rmsg.Header.RCode == dnsmessage.RCodeSuccess && len(rmsg.Answers) == 0:
+		d, ok := negativeTTL(rmsg.Authorities)
+		if !ok {
+			return
+		}
+		ttl = c.clamp(d)
+		if c.MaxNegativeTTL > 0 && ttl > c.MaxNegativeTTL {
+			ttl = c.MaxNegativeTTL
+		}
+	case rmsg.Header.RCode == dnsmessage.RCodeSuccess:
+		ttl = c.clamp(minTTL(rmsg.Answers))
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	e := &entry{
+		key: k,
+		msg: dnsmessage.Message{
+			Header:      dnsmessage.Header{RCode: rmsg.Header.RCode, Authoritative: rmsg.Header.Authoritative},
+			Answers:     copyResources(rmsg.Answers),
+			Authorities: copyResources(rmsg.Authorities),
+			Additionals: copyResources(rmsg.Additionals),
+		},
+		cred:   cred,
+		stored: c.now(),
+	}
+	e.expires = e.stored.Add(ttl)
+	e.size = msgSize(e.msg)
+	c.shard(k).put(e, perShard(c.MaxEntries), perShard(c.MaxBytes), &c.evictions)
+}
+
+func (s *shard) put(e *entry, maxEntries, maxBytes int, evictions *uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.m[e.key]; ok {
+		old := el.Value.(*entry)
+		if old.cred > e.cred && e.stored.Before(old.expires) {
+			return
+		}
+		s.remove(el)
+	}
+	s.m[e.key] = s.lru.PushFront(e)
+	s.bytes += e.size
+	for s.lru.Len() > 1 && (maxEntries > 0 && s.lru.Len() > maxEntries || maxBytes > 0 && s.bytes > maxBytes) {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(evictions, 1)
+	}
+}
+
+// perShard divides the limit n between shards, rounding up
+// so that small non-zero limits remain limits.
+func perShard(n int) int {
+	return (n + nshards - 1) / nshards
+}
+
+func (s *shard) remove(el *list.Element) {
+	e := s.lru.Remove(el).(*entry)
+	delete(s.m, e.key)
+	s.bytes -= e.size
+}
+
+// RemoveExpired removes all answers which expired more than StaleTTL
+// ago from the cache, returning the number removed.
+func (c *Cache) RemoveExpired() int {
+	c.init()
+	now := c.now().Add(-c.StaleTTL)
+	var n int
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for _, el := range s.m {
+			if !now.Before(el.Value.(*entry).expires) {
+				s.remove(el)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Stats returns the cache's counters and current size.
+func (c *Cache) Stats() Stats {
+	c.init()
+	st := Stats{
+		Hits:       atomic.LoadUint64(&c.hits),
+		Misses:     atomic.LoadUint64(&c.misses),
+		Evictions:  atomic.LoadUint64(&c.evictions),
+		StaleHits:  atomic.LoadUint64(&c.stale),
+		Prefetches: atomic.LoadUint64(&c.prefetch),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		st.Entries += s.lru.Len()
+		st.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return st
+}
+
+func (c *Cache) clamp(ttl time.Duration) time.Duration {
+	if ttl < c.MinTTL {
+		return c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		return c.MaxTTL
+	}
+	return ttl
+}
+
+// answer returns a copy of the entry's message answering q
+// with TTLs set to ttl.
+func (e *entry) answer(q dnsmessage.Question, ttl uint32) dnsmessage.Message {
+	msg := e.msg
+	msg.Questions = []dnsmessage.Question{q}
+	msg.Answers = aged(e.msg.Answers, ttl)
+	msg.Authorities = aged(e.msg.Authorities, ttl)
+	msg.Additionals = aged(e.msg.Additionals, ttl)
+	return msg
+}
+
+func aged(rrs []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	rrs = copyResources(rrs)
+	for i := range rrs {
+		// the TTL field of an OPT record holds flags.
+		if rrs[i].Header.Type != dnsmessage.TypeOPT {
+			rrs[i].Header.TTL = ttl
+		}
+	}
+	return rrs
+}
+
+func copyResources(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return nil
+	}
+	c := make([]dnsmessage.Resource, len(rrs))
+	copy(c, rrs)
+	return c
+}
+
+// minTTL returns the lowest TTL of rrs, or zero if rrs is empty.
+func minTTL(rrs []dnsmessage.Resource) time.Duration {
+	if len(rrs) == 0 {
+		return 0
+	}
+	least := rrs[0].Header.TTL
+	for _, r := range rrs[1:] {
+		if r.Header.TTL < least {
+			least = r.Header.TTL
+		}
+	}
+	return time.Duration(least) * time.Second
+}
+
+// negativeTTL returns the lesser of the TTL and minimum TTL of the
+// SOA record in authorities (RFC 2308 section 5).
+func negativeTTL(authorities []dnsmessage.Resource) (time.Duration, bool) {
+	for _, r := range authorities {
+		soa, ok := r.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl := r.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
+}
+
+// entryOverhead approximates the memory used by an entry
+// excluding its resources.
+const entryOverhead = 256
+
+// resourceOverhead approximates the memory used by a resource
+// excluding its name and data.
+const resourceOverhead = 64
+
+// msgSize estimates the memory used by an entry holding msg.
+func msgSize(msg dnsmessage.Message) int {
+	n := entryOverhead
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range section {
+			n += resourceOverhead + int(r.Header.Name.Length) + bodySize(r.Body)
+		}
+	}
+	return n
+}
+
+func bodySize(body dnsmessage.ResourceBody) int {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return 4
+	case *dnsmessage.AAAAResource:
+		return 16
+	case *dnsmessage.NSResource:
+		return int(b.NS.Length)
+	case *dnsmessage.CNAMEResource:
+		return int(b.CNAME.Length)
+	case *dnsmessage.PTRResource:
+		return int(b.PTR.Length)
+	case *dnsmessage.MXResource:
+		return 2 + int(b.MX.Length)
+	case *dnsmessage.SRVResource:
+		return 6 + int(b.Target.Length)
+	case *dnsmessage.SOAResource:
+		return 20 + int(b.NS.Length) + int(b.MBox.Length)
+	case *dnsmessage.TXTResource:
+		var n int
+		for _, s := range b.TXT {
+			n += len(s) + 16
+		}
+		return n
+	case *dnsmessage.UnknownResource:
+		return len(b.Data)
+	}
+	return resourceOverhead
+}
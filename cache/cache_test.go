@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// clock is a fake time source for tests.
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestCache() (*Cache, *clock) {
+	clk := &clock{t: time.Unix(1e9, 0)}
+	return &Cache{now: clk.now}, clk
+}
+
+func question(name string, t dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET}
+}
+
+func answer(name string, ttl uint32) dnsmessage.Message {
+	return dnsmessage.Message{
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+}
+
+func negative(rcode dnsmessage.RCode, soaTTL, minTTL uint32) dnsmessage.Message {
+	zone := dnsmessage.MustNewName("example.test.")
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{RCode: rcode},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: soaTTL},
+			Body:   &dnsmessage.SOAResource{NS: zone, MBox: zone, Serial: 1, MinTTL: minTTL},
+		}},
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c, clk := newTestCache()
+	q := question("www.example.test.", dnsmessage.TypeA)
+	rmsg := answer("www.example.test.", 300)
+	rmsg.Answers = append(rmsg.Answers, answer("www.example.test.", 60).Answers...)
+	c.Put(q, rmsg)
+
+	clk.advance(20 * time.Second)
+	got, ok := c.Get(q)
+	if !ok {
+		t.Fatal("cached answer not found")
+	}
+	for _, r := range got.Answers {
+		if r.Header.TTL != 40 {
+			t.Errorf("ttl %d after 20s, want 40", r.Header.TTL)
+		}
+	}
+	// names are compared case-insensitively.
+	if _, ok := c.Get(question("WWW.example.test.", dnsmessage.TypeA)); !ok {
+		t.Error("lookup of name in different case missed")
+	}
+	clk.advance(40 * time.Second)
+	if _, ok := c.Get(q); ok {
+		t.Error("found expired answer")
+	}
+	if st := c.Stats(); st.Entries != 0 {
+		t.Errorf("%d entries after expiry, want 0", st.Entries)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	c, _ := newTestCache()
+	c.MinTTL, c.MaxTTL, c.MaxNegativeTTL = 30*time.Second, time.Hour, 10*time.Minute
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		want uint32
+	}{
+		{"low.example.test.", answer("low.example.test.", 5), 30},
+		{"high.example.test.", answer("high.example.test.", 86400), 3600},
+		{"ok.example.test.", answer("ok.example.test.", 600), 600},
+		{"neg.example.test.", negative(dnsmessage.RCodeNameError, 86400, 86400), 600},
+	}
+	for _, tt := range tests {
+		q := question(tt.name, dnsmessage.TypeA)
+		c.Put(q, tt.msg)
+		got, ok := c.Get(q)
+		if !ok {
+			t.Errorf("%s not cached", tt.name)
+			continue
+		}
+		rrs := append(got.Answers, got.Authorities...)
+		if rrs[0].Header.TTL != tt.want {
+			t.Errorf("%s: ttl %d, want %d", tt.name, rrs[0].Header.TTL, tt.want)
+		}
+	}
+}
+
+func TestNegative(t *testing.T) {
+	c, clk := newTestCache()
+	c.Put(question("nx.example.test.", dnsmessage.TypeA), negative(dnsmessage.RCodeNameError, 3600, 300))
+	// NXDOMAIN applies to all types.
+	got, ok := c.Get(question("nx.example.test.", dnsmessage.TypeAAAA))
+	if !ok {
+		t.Fatal("cached NXDOMAIN not found")
+	}
+	if got.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("rcode %s, want %s", got.Header.RCode, dnsmessage.RCodeNameError)
+	}
+	if len(got.Authorities) != 1 || got.Authorities[0].Header.TTL != 300 {
+		t.Errorf("want SOA with TTL of SOA minimum, got %v", got.Authorities)
+	}
+	if got.Questions[0].Type != dnsmessage.TypeAAAA {
+		t.Errorf("answer has question type %s, want %s", got.Questions[0].Type, dnsmessage.TypeAAAA)
+	}
+
+	q := question("nodata.example.test.", dnsmessage.TypeAAAA)
+	c.Put(q, negative(dnsmessage.RCodeSuccess, 100, 300))
+	got, ok = c.Get(q)
+	if !ok {
+		t.Fatal("cached NODATA not found")
+	}
+	if got.Header.RCode != dnsmessage.RCodeSuccess || len(got.Answers) != 0 || got.Authorities[0].Header.TTL != 100 {
+		t.Errorf("want NODATA answer with SOA TTL 100, got %+v", got)
+	}
+	if _, ok := c.Get(question("nodata.example.test.", dnsmessage.TypeA)); ok {
+		t.Error("NODATA for AAAA served for A")
+	}
+	clk.advance(300 * time.Second)
+	if _, ok := c.Get(question("nx.example.test.", dnsmessage.TypeA)); ok {
+		t.Error("found expired NXDOMAIN")
+	}
+
+	// without a SOA record there is no negative TTL.
+	q = question("nosoa.example.test.", dnsmessage.TypeA)
+	c.Put(q, dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}})
+	if _, ok := c.Get(q); ok {
+		t.Error("cached negative answer without SOA")
+	}
+	// nor are failures cached.
+	c.Put(q, dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}})
+	if _, ok := c.Get(q); ok {
+		t.Error("cached SERVFAIL")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c, _ := newTestCache()
+	c.MaxEntries = nshards
+	// fill the cache well beyond its limit.
+	const n = 100 * nshards
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%d.example.test.", i)
+		c.Put(question(name, dnsmessage.TypeA), answer(name, 3600))
+	}
+	st := c.Stats()
+	if st.Entries > c.MaxEntries {
+		t.Errorf("%d entries, want at most %d", st.Entries, c.MaxEntries)
+	}
+	if st.Evictions != uint64(n-st.Entries) {
+		t.Errorf("%d evictions, want %d", st.Evictions, n-st.Entries)
+	}
+	// the most recent entry is never the one evicted.
+	name := fmt.Sprintf("%d.example.test.", n-1)
+	if _, ok := c.Get(question(name, dnsmessage.TypeA)); !ok {
+		t.Errorf("most recently added %s evicted", name)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c, _ := newTestCache()
+	c.MaxEntries = 2 * nshards
+	// find three names in the same shard.
+	var names []string
+	first := c.shard(newKey(dnsmessage.MustNewName("0.example.test."), dnsmessage.TypeA, dnsmessage.ClassINET))
+	for i := 0; len(names) < 3; i++ {
+		name := fmt.Sprintf("%d.example.test.", i)
+		if c.shard(newKey(dnsmessage.MustNewName(name), dnsmessage.TypeA, dnsmessage.ClassINET)) == first {
+			names = append(names, name)
+		}
+	}
+	c.Put(question(names[0], dnsmessage.TypeA), answer(names[0], 3600))
+	c.Put(question(names[1], dnsmessage.TypeA), answer(names[1], 3600))
+	// using the first makes the second least recently used.
+	c.Get(question(names[0], dnsmessage.TypeA))
+	c.Put(question(names[2], dnsmessage.TypeA), answer(names[2], 3600))
+	if _, ok := c.Get(question(names[1], dnsmessage.TypeA)); ok {
+		t.Errorf("least recently used %s not evicted", names[1])
+	}
+	if _, ok := c.Get(question(names[0], dnsmessage.TypeA)); !ok {
+		t.Errorf("recently used %s evicted", names[0])
+	}
+	st := c.Stats()
+	if st.Hits != 2 || st.Misses != 1 || st.Evictions != 1 {
+		t.Errorf("got %+v, want 2 hits, 1 miss and 1 eviction", st)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	c, _ := newTestCache()
+	c.MaxBytes = 64 << 10
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("%d.example.test.", i)
+		c.Put(question(name, dnsmessage.TypeA), answer(name, 3600))
+	}
+	if st := c.Stats(); st.Bytes > c.MaxBytes {
+		t.Errorf("cache uses %d bytes, want at most %d", st.Bytes, c.MaxBytes)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	c, clk := newTestCache()
+	c.Put(question("short.example.test.", dnsmessage.TypeA), answer("short.example.test.", 10))
+	c.Put(question("long.example.test.", dnsmessage.TypeA), answer("long.example.test.", 3600))
+	clk.advance(time.Minute)
+	if n := c.RemoveExpired(); n != 1 {
+		t.Errorf("removed %d entries, want 1", n)
+	}
+	if st := c.Stats(); st.Entries != 1 {
+		t.Errorf("%d entries remain, want 1", st.Entries)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c := &Cache{MaxEntries: 1000}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				name := fmt.Sprintf("%d.%d.example.test.", i, g)
+				c.Put(question(name, dnsmessage.TypeA), answer(name, 3600))
+				c.Get(question(name, dnsmessage.TypeA))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if st := c.Stats(); st.Hits+st.Misses != 8000 {
+		t.Errorf("%d lookups counted, want 8000", st.Hits+st.Misses)
+	}
+}
+
+func TestStale(t *testing.T) {
+	c, clk := newTestCache()
+	c.StaleTTL = time.Hour
+	q := question("stale.example.test.", dnsmessage.TypeA)
+	c.Put(q, answer("stale.example.test.", 60))
+
+	got, ok := c.GetStale(q)
+	if !ok {
+		t.Fatal("fresh answer not returned by GetStale")
+	}
+	if ttl := got.Answers[0].Header.TTL; ttl != 60 {
+		t.Errorf("fresh answer ttl %d, want 60", ttl)
+	}
+	clk.advance(10 * time.Minute)
+	if _, ok := c.Get(q); ok {
+		t.Error("Get returned stale answer")
+	}
+	got, ok = c.GetStale(q)
+	if !ok {
+		t.Fatal("stale answer not found")
+	}
+	if ttl := got.Answers[0].Header.TTL; ttl != staleAnswerTTL {
+		t.Errorf("stale answer ttl %d, want %d", ttl, staleAnswerTTL)
+	}
+	if n := c.RemoveExpired(); n != 0 {
+		t.Errorf("removed %d entries within stale window", n)
+	}
+	if st := c.Stats(); st.StaleHits != 1 {
+		t.Errorf("%d stale hits, want 1", st.StaleHits)
+	}
+
+	clk.advance(time.Hour)
+	if n := c.RemoveExpired(); n != 1 {
+		t.Errorf("removed %d entries past stale window, want 1", n)
+	}
+	if _, ok := c.GetStale(q); ok {
+		t.Error("found answer past stale window")
+	}
+
+	glue := question("ns.stale.example.test.", dnsmessage.TypeA)
+	c.PutCredibility(glue, answer("ns.stale.example.test.", 60), CredAdditional)
+	if _, ok := c.GetStale(glue); ok {
+		t.Error("GetStale returned glue")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	c, clk := newTestCache()
+	prefetched := make(chan dnsmessage.Question, 10)
+	c.Prefetch = func(q dnsmessage.Question) { prefetched <- q }
+	c.PrefetchHits = 2
+	popular := question("popular.example.test.", dnsmessage.TypeA)
+	unpopular := question("unpopular.example.test.", dnsmessage.TypeA)
+	c.Put(popular, answer("popular.example.test.", 100))
+	c.Put(unpopular, answer("unpopular.example.test.", 100))
+
+	c.Get(popular)
+	c.Get(popular)
+	// not yet near expiry.
+	c.Get(popular)
+	clk.advance(95 * time.Second)
+	c.Get(unpopular)
+	c.Get(popular)
+	c.Get(popular)
+	select {
+	case q := <-prefetched:
+		if q != popular {
+			t.Errorf("prefetched %v, want %v", q, popular)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("popular answer not prefetched")
+	}
+	select {
+	case q := <-prefetched:
+		t.Errorf("unexpected prefetch of %v", q)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := c.Stats(); st.Prefetches != 1 {
+		t.Errorf("%d prefetches, want 1", st.Prefetches)
+	}
+}
+
+func TestCredibility(t *testing.T) {
+	c, clk := newTestCache()
+	q := question("ns1.example.test.", dnsmessage.TypeA)
+	auth := answer("ns1.example.test.", 300)
+	auth.Header.Authoritative = true
+	c.Put(q, auth)
+
+	glue := answer("ns1.example.test.", 600)
+	glue.Answers[0].Body = &dnsmessage.AResource{A: [4]byte{192, 0, 2, 99}}
+	c.PutCredibility(q, glue, CredAdditional)
+	got, ok := c.Get(q)
+	if !ok {
+		t.Fatal("cached answer not found")
+	}
+	if a := got.Answers[0].Body.(*dnsmessage.AResource).A; a != [4]byte{192, 0, 2, 1} {
+		t.Errorf("glue %v replaced authoritative answer", a)
+	}
+
+	// once the authoritative answer expires, glue may take its place.
+	clk.advance(5 * time.Minute)
+	c.PutCredibility(q, glue, CredAdditional)
+	if _, ok := c.Get(q); !ok {
+		t.Fatal("glue not cached after authoritative answer expired")
+	}
+	if _, ok := c.GetCredible(q, CredAnswer); ok {
+		t.Error("glue returned as credible answer")
+	}
+	c.Put(q, auth)
+	if _, ok := c.GetCredible(q, CredAnswer); !ok {
+		t.Error("authoritative answer did not replace glue")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -12,6 +13,9 @@ type config struct {
 	forwardaddr string
 	listenaddr  string
 	usetls      bool
+	// cachesize is the number of answers to cache; 0, the default,
+	// disables caching.
+	cachesize int
 }
 
 func configFromFile(name string) (config, error) {
@@ -54,6 +58,17 @@ func parseConfig(r io.Reader) (config, error) {
 					return c, fmt.Errorf("invalid tls option in forward")
 				}
 			}
+		case "cache":
+			if len(fields) < 2 {
+				return c, fmt.Errorf("missing value for key %s", k)
+			} else if len(fields) > 2 {
+				return c, fmt.Errorf("too many values for key %s", k)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 0 {
+				return c, fmt.Errorf("invalid cache size %s", fields[1])
+			}
+			c.cachesize = n
 		default:
 			return c, fmt.Errorf("unknown key %s", k)
 		}
@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"olowe.co/dns"
+	"olowe.co/dns/cache"
 )
 
 type metrics struct {
@@ -86,6 +88,18 @@ func dnsHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	cacheable := answers != nil && len(msg.Questions) == 1
+	if cacheable {
+		if cached, ok := answers.Get(msg.Questions[0]); ok {
+			cached.Header.ID = msg.Header.ID
+			cached.Header.Response = true
+			cached.Header.RecursionDesired = msg.Header.RecursionDesired
+			cached.Header.RecursionAvailable = true
+			writeMsg(w, cached)
+			return
+		}
+	}
+
 	var resolved dnsmessage.Message
 	if conf.usetls {
 		resolved, err = dns.ExchangeTLS(msg, conf.forwardaddr)
@@ -98,7 +112,14 @@ func dnsHandler(w http.ResponseWriter, req *http.Request) {
 		counter.httpError++
 		return
 	}
-	packed, err := resolved.Pack()
+	if cacheable {
+		answers.Put(msg.Questions[0], resolved)
+	}
+	writeMsg(w, resolved)
+}
+
+func writeMsg(w http.ResponseWriter, msg dnsmessage.Message) {
+	packed, err := msg.Pack()
 	if err != nil {
 		log.Println("pack resolved query:", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -115,12 +136,25 @@ func dnsHandler(w http.ResponseWriter, req *http.Request) {
 var conf config
 var counter metrics
 
+// answers caches upstream answers. It is nil if caching is disabled.
+var answers *cache.Cache
+
 func metricsHandler (w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Content-Type", "text/plain")
 	w.Write([]byte("# TYPE http_requests_total counter\n"))
 	w.Write([]byte(fmt.Sprintf("http_requests_total{code=\"%d\"} %d\n", http.StatusOK, counter.httpOK)))
 	w.Write([]byte(fmt.Sprintf("http_requests_total{code=\"%d\"} %d\n", http.StatusInternalServerError, counter.httpError)))
 	w.Write([]byte(fmt.Sprintf("http_requests_total{code=\"4xx\"} %d\n", counter.httpBadReq)))
+	if answers != nil {
+		st := answers.Stats()
+		w.Write([]byte("# TYPE dns_cache_lookups_total counter\n"))
+		w.Write([]byte(fmt.Sprintf("dns_cache_lookups_total{result=\"hit\"} %d\n", st.Hits)))
+		w.Write([]byte(fmt.Sprintf("dns_cache_lookups_total{result=\"miss\"} %d\n", st.Misses)))
+		w.Write([]byte("# TYPE dns_cache_evictions_total counter\n"))
+		w.Write([]byte(fmt.Sprintf("dns_cache_evictions_total %d\n", st.Evictions)))
+		w.Write([]byte("# TYPE dns_cache_entries gauge\n"))
+		w.Write([]byte(fmt.Sprintf("dns_cache_entries %d\n", st.Entries)))
+	}
 }
 
 func main() {
@@ -130,6 +164,14 @@ func main() {
 		fmt.Fprintln(os.Stderr, "read configuration:", err)
 		os.Exit(1)
 	}
+	if conf.cachesize > 0 {
+		answers = &cache.Cache{MaxEntries: conf.cachesize, MaxTTL: 24 * time.Hour, MaxNegativeTTL: 3 * time.Hour}
+		go func() {
+			for range time.Tick(time.Minute) {
+				answers.RemoveExpired()
+			}
+		}()
+	}
 	http.HandleFunc("/dns-query", dnsHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 	log.Fatalln(http.Serve(autocert.NewListener(conf.listenaddr), nil))
@@ -44,3 +44,23 @@ forward 9.9.9.9:853 badoption`
 		t.Error(err)
 	}
 }
+
+func TestCacheConfig(t *testing.T) {
+	config, err := parseConfig(strings.NewReader("listen syd.olowe.co\nforward 9.9.9.9:domain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.cachesize != 0 {
+		t.Errorf("default cache size %d, want 0", config.cachesize)
+	}
+	config, err = parseConfig(strings.NewReader("cache 10000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.cachesize != 10000 {
+		t.Errorf("cache size %d, want 10000", config.cachesize)
+	}
+	if _, err := parseConfig(strings.NewReader("cache lots")); err == nil {
+		t.Error("nil error parsing invalid cache size")
+	}
+}
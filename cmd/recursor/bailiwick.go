@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+	"olowe.co/dns/cache"
+)
+
+// The nameservers of a zone are only trusted for data in that zone,
+// its bailiwick. Anything else in their responses is discarded, so
+// that a server cannot poison the cache with data for zones it does
+// not serve.
+
+// inBailiwick returns the resources in rrs named in or below zone.
+func inBailiwick(rrs []dnsmessage.Resource, zone dnsmessage.Name) []dnsmessage.Resource {
+	var in []dnsmessage.Resource
+	for _, r := range rrs {
+		if dns.IsSubdomain(r.Header.Name, zone) {
+			in = append(in, r)
+		}
+	}
+	return in
+}
+
+// sanitise removes the resources outside zone from rmsg,
+// an answer from the nameservers of zone.
+func sanitise(rmsg dnsmessage.Message, zone dnsmessage.Name) dnsmessage.Message {
+	rmsg.Answers = inBailiwick(rmsg.Answers, zone)
+	rmsg.Authorities = inBailiwick(rmsg.Authorities, zone)
+	rmsg.Additionals = inBailiwick(rmsg.Additionals, zone)
+	return rmsg
+}
+
+// delegation returns the NS records from the authority section of a
+// referral from the nameservers of zone while resolving name. A
+// referral is only accepted for a zone below the one asked, and at
+// or above name; the NS records of any other zone are ignored.
+func delegation(authorities []dnsmessage.Resource, name, zone dnsmessage.Name) []dnsmessage.Resource {
+	var ns []dnsmessage.Resource
+	for _, r := range authorities {
+		if _, ok := r.Body.(*dnsmessage.NSResource); !ok {
+			continue
+		}
+		owner := r.Header.Name
+		if strings.EqualFold(owner.String(), zone.String()) || !dns.IsSubdomain(owner, zone) || !dns.IsSubdomain(name, owner) {
+			continue
+		}
+		if len(ns) > 0 && !strings.EqualFold(owner.String(), ns[0].Header.Name.String()) {
+			continue
+		}
+		ns = append(ns, r)
+	}
+	return ns
+}
+
+// glue returns the addresses of the nameserver named ns found in
+// additionals. Addresses are only accepted from the nameservers of
+// zone if ns is in zone.
+func glue(additionals []dnsmessage.Resource, ns, zone dnsmessage.Name) []dnsmessage.Resource {
+	if !dns.IsSubdomain(ns, zone) {
+		return nil
+	}
+	addrs := filterRRs(additionals, ns, dnsmessage.TypeA)
+	return append(addrs, filterRRs(additionals, ns, dnsmessage.TypeAAAA)...)
+}
+
+// cacheReferral caches the NS records of a delegation from zone and
+// any glue for them in additionals. Neither replaces cached answers
+// from the child zone's own nameservers, which are more credible.
+func cacheReferral(ns, additionals []dnsmessage.Resource, zone dnsmessage.Name) {
+	insert(ns[0].Header.Name, dnsmessage.TypeNS, ns, cache.CredAuthority)
+	for _, r := range ns {
+		name := r.Body.(*dnsmessage.NSResource).NS
+		if !dns.IsSubdomain(name, zone) {
+			continue
+		}
+		for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			if rrs := filterRRs(additionals, name, t); len(rrs) > 0 {
+				insert(name, t, rrs, cache.CredAdditional)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns/cache"
+)
+
+func testNS(zone, ns string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(ns)},
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	zone := dnsmessage.MustNewName("com.")
+	name := dnsmessage.MustNewName("www.example.com.")
+	authorities := []dnsmessage.Resource{
+		testNS("com.", "evil.example.net."),        // not a delegation
+		testNS("example.org.", "ns.example.org."),  // outside zone
+		testNS("other.com.", "ns.other.com."),      // not above name
+		testNS("example.com.", "ns1.example.com."), // ok
+		testNS("example.com.", "ns.example.net."),  // ok
+	}
+	ns := delegation(authorities, name, zone)
+	if len(ns) != 2 {
+		t.Fatalf("got %d NS records, want 2: %v", len(ns), ns)
+	}
+	for _, r := range ns {
+		if r.Header.Name.String() != "example.com." {
+			t.Errorf("accepted NS record for %s", r.Header.Name)
+		}
+	}
+}
+
+func TestGlue(t *testing.T) {
+	zone := dnsmessage.MustNewName("com.")
+	additionals := []dnsmessage.Resource{
+		testA("ns1.example.com.", 3600),
+		testA("ns.example.net.", 3600),
+		testA("www.example.org.", 3600),
+	}
+	if rrs := glue(additionals, dnsmessage.MustNewName("ns1.example.com."), zone); len(rrs) != 1 {
+		t.Errorf("got %d in-bailiwick glue records, want 1", len(rrs))
+	}
+	if rrs := glue(additionals, dnsmessage.MustNewName("ns.example.net."), zone); len(rrs) != 0 {
+		t.Errorf("accepted glue for ns.example.net. from nameservers of %s", zone)
+	}
+
+	rmsg := dnsmessage.Message{Answers: additionals}
+	if rrs := sanitise(rmsg, zone).Answers; len(rrs) != 1 || rrs[0].Header.Name.String() != "ns1.example.com." {
+		t.Errorf("sanitised answers: got %v", rrs)
+	}
+}
+
+func TestGlueNotOverwrite(t *testing.T) {
+	name := dnsmessage.MustNewName("ns1.glue.test.")
+	auth := testA(name.String(), 3600)
+	insert(name, dnsmessage.TypeA, []dnsmessage.Resource{auth}, cache.CredAuthAnswer)
+
+	bogus := testA(name.String(), 3600)
+	bogus.Body = &dnsmessage.AResource{A: [4]byte{198, 51, 100, 1}}
+	ns := []dnsmessage.Resource{testNS("glue.test.", name.String())}
+	cacheReferral(ns, []dnsmessage.Resource{bogus}, dnsmessage.MustNewName("test."))
+	rrs, ok := lookup(name, dnsmessage.TypeA)
+	if !ok || len(rrs) != 1 {
+		t.Fatalf("lookup %s: got %v, %v", name, rrs, ok)
+	}
+	if a := rrs[0].Body.(*dnsmessage.AResource).A; a != [4]byte{192, 0, 2, 1} {
+		t.Errorf("glue %v replaced authoritative address", a)
+	}
+}
@@ -1,42 +1,70 @@
 package main
 
 import (
+	"time"
+
 	"golang.org/x/net/dns/dnsmessage"
-	"sync"
+	"olowe.co/dns/cache"
 )
 
-var cache = struct {
-	m map[dnsmessage.Name]map[dnsmessage.Type][]dnsmessage.Resource
-	sync.RWMutex
-}{m: make(map[dnsmessage.Name]map[dnsmessage.Type][]dnsmessage.Resource)}
+// answers holds resources and negative answers learned while resolving.
+// Limits are set from flags in main.
+var answers = &cache.Cache{
+	MaxEntries:     100000,
+	MaxTTL:         24 * time.Hour,
+	MaxNegativeTTL: 3 * time.Hour,
+	// RFC 8767 section 5 suggests keeping stale data for 1 to 3 days.
+	StaleTTL: 24 * time.Hour,
+}
 
+// lookup returns the cached resources of type t named n.
+// The TTL of each resource is decremented by the time it has been cached.
 func lookup(n dnsmessage.Name, t dnsmessage.Type) ([]dnsmessage.Resource, bool) {
-	cache.RLock()
-	if rr, ok := cache.m[n][t]; ok {
-		cache.RUnlock()
-		if expired(n, t) {
-			cache.Lock()
-			delete(cache.m[n], t)
-			cache.Unlock()
-			return nil, false
-		}
-		return rr, true
+	rmsg, ok := answers.Get(question(n, t))
+	if !ok || isNegative(rmsg) {
+		return nil, false
 	}
-	l := len(cache.m[n])
-	cache.RUnlock()
-	if l < 1 {
-		cache.Lock()
-		cache.m[n] = make(map[dnsmessage.Type][]dnsmessage.Resource)
-		cache.Unlock()
+	return rmsg.Answers, true
+}
+
+// lookupNegative returns a cached negative answer for resources of
+// type t named n. The message has the cached RCode and the SOA record
+// in its authority section.
+func lookupNegative(n dnsmessage.Name, t dnsmessage.Type) (dnsmessage.Message, bool) {
+	rmsg, ok := answers.Get(question(n, t))
+	if !ok || !isNegative(rmsg) {
+		return dnsmessage.Message{}, false
 	}
-	return nil, false
+	return rmsg, true
+}
+
+// insert caches rrs as the answer to a query for resources of type t
+// named n. They do not replace cached resources of greater credibility.
+func insert(n dnsmessage.Name, t dnsmessage.Type, rrs []dnsmessage.Resource, cred cache.Credibility) {
+	answers.PutCredibility(question(n, t), dnsmessage.Message{Answers: rrs}, cred)
 }
 
-func insert(n dnsmessage.Name, t dnsmessage.Type, rrs []dnsmessage.Resource) {
-	cache.Lock()
-	cache.m[n][t] = rrs
-	cache.Unlock()
-	return
+// insertNegative caches the negative answer in rmsg to a query for
+// resources of type t named n.
+func insertNegative(n dnsmessage.Name, t dnsmessage.Type, rmsg dnsmessage.Message) {
+	answers.Put(question(n, t), dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: rmsg.Header.RCode, Authoritative: rmsg.Header.Authoritative},
+		Authorities: rmsg.Authorities,
+	})
 }
 
-func expired(n dnsmessage.Name, t dnsmessage.Type) bool { return false }
+func question(n dnsmessage.Name, t dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}
+}
+
+func isNegative(rmsg dnsmessage.Message) bool {
+	return rmsg.Header.RCode == dnsmessage.RCodeNameError || len(rmsg.Answers) == 0
+}
+
+// evictEvery removes expired entries from the cache at each interval.
+// It never returns.
+func evictEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		answers.RemoveExpired()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns/cache"
+)
+
+func testA(name string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+}
+
+func TestCache(t *testing.T) {
+	name := dnsmessage.MustNewName("positive.example.test.")
+	insert(name, dnsmessage.TypeA, []dnsmessage.Resource{testA(name.String(), 300)}, cache.CredAuthAnswer)
+	if rrs, ok := lookup(name, dnsmessage.TypeA); !ok || len(rrs) != 1 {
+		t.Errorf("lookup cached record: got %v, %v", rrs, ok)
+	}
+	if _, ok := lookupNegative(name, dnsmessage.TypeA); ok {
+		t.Error("positive answer served as negative")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	zone := dnsmessage.MustNewName("example.test.")
+	rmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{Authoritative: true, RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.SOAResource{NS: zone, MBox: zone, Serial: 1, MinTTL: 300},
+		}},
+	}
+	nx := dnsmessage.MustNewName("nx.example.test.")
+	insertNegative(nx, dnsmessage.TypeA, rmsg)
+	// NXDOMAIN applies to all types.
+	m, ok := lookupNegative(nx, dnsmessage.TypeAAAA)
+	if !ok {
+		t.Fatal("cached NXDOMAIN not found")
+	}
+	if m.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("rcode %s, want %s", m.Header.RCode, dnsmessage.RCodeNameError)
+	}
+	if len(m.Authorities) != 1 || m.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+		t.Errorf("want SOA in authority section, got %v", m.Authorities)
+	}
+
+	nodata := dnsmessage.MustNewName("nodata.example.test.")
+	rmsg.Header.RCode = dnsmessage.RCodeSuccess
+	insertNegative(nodata, dnsmessage.TypeAAAA, rmsg)
+	if _, ok := lookupNegative(nodata, dnsmessage.TypeAAAA); !ok {
+		t.Error("cached NODATA not found")
+	}
+	if _, ok := lookup(nodata, dnsmessage.TypeAAAA); ok {
+		t.Error("NODATA served as positive answer")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+	"olowe.co/dns/cache"
+)
+
+// typeDNAME is the type of DNAME records (RFC 6672), which dnsmessage
+// does not know about.
+const typeDNAME dnsmessage.Type = 39
+
+var (
+	errChainLoop    = errors.New("alias loop")
+	errChainTooLong = errors.New("alias chain too long")
+)
+
+// A link is one step in a chain of aliases.
+type link struct {
+	name   dnsmessage.Name       // the alias
+	rrs    []dnsmessage.Resource // its CNAME, or a DNAME and the CNAME synthesised from it
+	target dnsmessage.Name
+}
+
+// resolveChain resolves q from the root, following any CNAME and DNAME
+// records across zones until records of the question's type are found.
+// The answer section of the returned message holds the whole chain
+// followed by the records at its end.
+func resolveChain(q dnsmessage.Question, b *budget) (dnsmessage.Message, error) {
+	var chain []dnsmessage.Resource
+	seen := map[string]bool{strings.ToLower(q.Name.String()): true}
+	next := q
+	for {
+		rmsg, err := resolve(next, roots, 0, b)
+		if err != nil {
+			return rmsg, err
+		}
+		links, target, data, err := follow(next, rmsg.Answers)
+		if err != nil {
+			return rmsg, fmt.Errorf("resolve %s: %w", q.Name, err)
+		}
+		for _, l := range links {
+			k := strings.ToLower(l.target.String())
+			if seen[k] {
+				return rmsg, fmt.Errorf("resolve %s: %w at %s", q.Name, errChainLoop, l.target)
+			}
+			seen[k] = true
+			chain = append(chain, l.rrs...)
+		}
+		if len(seen) > dns.MaxChain+1 {
+			return rmsg, fmt.Errorf("resolve %s: %w", q.Name, errChainTooLong)
+		}
+		if len(data) > 0 || len(links) == 0 {
+			// the response code, and any negative answer, are for
+			// the name at the end of the chain (RFC 6604).
+			rmsg.Answers = append(chain, data...)
+			return rmsg, nil
+		}
+		next = dnsmessage.Question{Name: target, Type: q.Type, Class: q.Class}
+	}
+}
+
+// follow walks the chain of aliases in rrs starting at the name of q.
+// It returns the links in order, the name at the end of the chain, and
+// the records of the question's type held there, if any.
+func follow(q dnsmessage.Question, rrs []dnsmessage.Resource) ([]link, dnsmessage.Name, []dnsmessage.Resource, error) {
+	var links []link
+	name := q.Name
+	for {
+		if data := filterRRs(rrs, name, q.Type); len(data) > 0 {
+			return links, name, data, nil
+		}
+		l, ok, err := alias(rrs, name)
+		if err != nil {
+			return nil, name, nil, err
+		} else if !ok {
+			return links, name, nil, nil
+		}
+		if strings.EqualFold(l.target.String(), q.Name.String()) {
+			return nil, name, nil, errChainLoop
+		}
+		for _, prev := range links {
+			if strings.EqualFold(l.target.String(), prev.name.String()) {
+				return nil, name, nil, errChainLoop
+			}
+		}
+		links = append(links, l)
+		if len(links) > dns.MaxChain {
+			return nil, name, nil, errChainTooLong
+		}
+		name = l.target
+	}
+}
+
+// alias returns the link from name in rrs, if any. A DNAME record is
+// preferred to a CNAME for the same name, as the CNAME a server
+// synthesises from a DNAME must be checked against it anyway.
+func alias(rrs []dnsmessage.Resource, name dnsmessage.Name) (link, bool, error) {
+	for _, r := range rrs {
+		if r.Header.Type != typeDNAME || !dns.IsSubdomain(name, r.Header.Name) || strings.EqualFold(name.String(), r.Header.Name.String()) {
+			continue
+		}
+		b, ok := r.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		to, _, err := dns.ReadName(b.Data, 0)
+		if err != nil {
+			return link{}, false, fmt.Errorf("parse DNAME %s: %w", r.Header.Name, err)
+		}
+		target, err := substitute(name, r.Header.Name, to)
+		if err != nil {
+			return link{}, false, err
+		}
+		cname := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeCNAME, Class: r.Header.Class, TTL: r.Header.TTL},
+			Body:   &dnsmessage.CNAMEResource{CNAME: target},
+		}
+		return link{name, []dnsmessage.Resource{r, cname}, target}, true, nil
+	}
+	for _, r := range filterRRs(rrs, name, dnsmessage.TypeCNAME) {
+		if b, ok := r.Body.(*dnsmessage.CNAMEResource); ok {
+			return link{name, []dnsmessage.Resource{r}, b.CNAME}, true, nil
+		}
+	}
+	return link{}, false, nil
+}
+
+// substitute replaces the suffix owner of name with target,
+// as specified for DNAME records in RFC 6672 section 2.2.
+func substitute(name, owner, target dnsmessage.Name) (dnsmessage.Name, error) {
+	n, o, t := name.String(), owner.String(), target.String()
+	prefix := strings.TrimSuffix(n[:len(n)-len(o)], ".")
+	s := prefix + "." + t
+	if t == "." {
+		s = prefix + "."
+	}
+	sub, err := dnsmessage.NewName(s)
+	if err != nil {
+		// RFC 6672 section 2.2: the result is too long (YXDOMAIN).
+		return dnsmessage.Name{}, fmt.Errorf("substitute DNAME %s for %s: %w", owner, name, err)
+	}
+	return sub, nil
+}
+
+// cacheAnswer caches the answer rmsg to q with the credibility cred.
+// Each link of a chain of aliases in the answer is cached separately
+// under its own name, so that each expires with its own TTL and can be
+// shared by other chains.
+func cacheAnswer(q dnsmessage.Question, rmsg dnsmessage.Message, cred cache.Credibility) {
+	links, target, data, err := follow(q, rmsg.Answers)
+	if err != nil {
+		return
+	}
+	for _, l := range links {
+		insert(l.name, q.Type, l.rrs, cred)
+	}
+	if len(data) > 0 {
+		insert(target, q.Type, data, cred)
+	} else if len(links) == 0 || hasSOAFor(rmsg.Authorities, target) {
+		insertNegative(target, q.Type, rmsg)
+	}
+}
+
+// hasSOAFor reports whether rrs contains the SOA record of a zone
+// holding name, meaning a negative answer applies to it.
+func hasSOAFor(rrs []dnsmessage.Resource, name dnsmessage.Name) bool {
+	for _, r := range rrs {
+		if r.Header.Type == dnsmessage.TypeSOA && dns.IsSubdomain(name, r.Header.Name) {
+			return true
+		}
+	}
+	return false
+}
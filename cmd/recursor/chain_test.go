@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+	"olowe.co/dns/cache"
+)
+
+func testCNAME(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func testDNAME(name, target string) dnsmessage.Resource {
+	var data []byte
+	for _, label := range []string{"example", "net"} {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	data = append(data, 0)
+	if target != "example.net." {
+		panic("unsupported DNAME target")
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typeDNAME, Class: dnsmessage.ClassINET, TTL: 600},
+		Body:   &dnsmessage.UnknownResource{Type: typeDNAME, Data: data},
+	}
+}
+
+func TestFollow(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rrs := []dnsmessage.Resource{
+		testA("cdn.example.org.", 60),
+		testCNAME("WWW.example.com.", "edge.example.com."),
+		testCNAME("edge.example.com.", "cdn.example.org."),
+	}
+	links, target, data, err := follow(q, rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || target.String() != "cdn.example.org." || len(data) != 1 {
+		t.Errorf("got %d links to %s with %d records, want 2 links to cdn.example.org. with 1 record", len(links), target, len(data))
+	}
+
+	// the chain leaves the response; the rest must be resolved.
+	links, target, data, err = follow(q, rrs[1:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || target.String() != "edge.example.com." || len(data) != 0 {
+		t.Errorf("got %d links to %s with %d records, want 1 link to edge.example.com.", len(links), target, len(data))
+	}
+
+	// asking for the CNAME itself doesn't follow it.
+	cq := q
+	cq.Type = dnsmessage.TypeCNAME
+	if links, _, data, _ := follow(cq, rrs); len(links) != 0 || len(data) != 1 {
+		t.Errorf("CNAME query: got %d links and %d records, want the CNAME record", len(links), len(data))
+	}
+
+	loop := []dnsmessage.Resource{
+		testCNAME("www.example.com.", "a.example.com."),
+		testCNAME("a.example.com.", "www.example.com."),
+	}
+	if _, _, _, err := follow(q, loop); !errors.Is(err, errChainLoop) {
+		t.Errorf("got error %v, want %v", err, errChainLoop)
+	}
+
+	var long []dnsmessage.Resource
+	name := "www.example.com."
+	for i := 0; i <= dns.MaxChain; i++ {
+		next := string(rune('a'+i)) + ".example.com."
+		long = append(long, testCNAME(name, next))
+		name = next
+	}
+	if _, _, _, err := follow(q, long); !errors.Is(err, errChainTooLong) {
+		t.Errorf("got error %v, want %v", err, errChainTooLong)
+	}
+}
+
+func TestDNAME(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("a.www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rrs := []dnsmessage.Resource{
+		testDNAME("example.com.", "example.net."),
+		// a bogus synthesised CNAME is ignored.
+		testCNAME("a.www.example.com.", "bogus.example.org."),
+		testA("a.www.example.net.", 60),
+	}
+	links, target, data, err := follow(q, rrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || target.String() != "a.www.example.net." || len(data) != 1 {
+		t.Fatalf("got %d links to %s with %d records, want 1 link to a.www.example.net.", len(links), target, len(data))
+	}
+	cname := links[0].rrs[1]
+	if cname.Header.TTL != 600 || cname.Body.(*dnsmessage.CNAMEResource).CNAME != target {
+		t.Errorf("bad synthesised CNAME %v", cname)
+	}
+
+	// DNAME records don't apply to their own name.
+	q.Name = dnsmessage.MustNewName("example.com.")
+	if links, _, _, _ := follow(q, rrs); len(links) != 0 {
+		t.Errorf("DNAME applied to its owner")
+	}
+}
+
+func TestCacheChain(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("alias.chain.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{Authoritative: true},
+		Answers: []dnsmessage.Resource{
+			testCNAME("alias.chain.test.", "target.chain.test."),
+			testA("target.chain.test.", 60),
+		},
+	}
+	cacheAnswer(q, rmsg, cache.CredAuthAnswer)
+	rrs, ok := lookup(q.Name, q.Type)
+	if !ok || len(rrs) != 1 || rrs[0].Header.Type != dnsmessage.TypeCNAME {
+		t.Errorf("alias: got %v, %v, want only the CNAME record", rrs, ok)
+	}
+	rrs, ok = lookup(dnsmessage.MustNewName("target.chain.test."), q.Type)
+	if !ok || len(rrs) != 1 || rrs[0].Header.Type != dnsmessage.TypeA {
+		t.Errorf("target: got %v, %v, want only the A record", rrs, ok)
+	}
+}
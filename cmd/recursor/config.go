@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// Settings without a home elsewhere, set by flags or the config file.
+var (
+	// listenAddrs are the addresses on which to serve queries over
+	// both UDP and TCP.
+	listenAddrs []string
+	// tlsAddrs and httpsAddrs are the addresses on which to serve
+	// queries using DNS over TLS and DNS over HTTPS, identifying
+	// ourselves with the certificate and key read from certFile and
+	// keyFile.
+	tlsAddrs, httpsAddrs []string
+	certFile, keyFile    string
+	// clientACL holds rules controlling which clients may use the
+	// resolver, applied after dns.DefaultACL.
+	clientACL dns.ACL
+
+	rootHints     string
+	prefetchHits  = 2
+	evictInterval = time.Minute
+)
+
+// defaultListenAddr is used if no listen addresses are configured.
+const defaultListenAddr = ":domain"
+
+// defineFlags defines the command line flags of the recursor in fs.
+// Each also names a key of the config file (see parseConfig).
+func defineFlags(fs *flag.FlagSet) {
+	fs.Var(listFlag{&listenAddrs}, "listen", "serve queries over UDP and TCP on `addr`; may be repeated")
+	fs.Var(listFlag{&tlsAddrs}, "listentls", "serve queries using DNS over TLS on `addr` (port 853 if omitted); may be repeated")
+	fs.Var(listFlag{&httpsAddrs}, "listenhttps", "serve queries using DNS over HTTPS on `addr` (port 443 if omitted); may be repeated")
+	fs.StringVar(&certFile, "cert", certFile, "read the TLS certificate chain from `file`")
+	fs.StringVar(&keyFile, "key", keyFile, "read the TLS private key from `file`")
+	fs.StringVar(&dohPath, "dohpath", dohPath, "serve DNS over HTTPS queries at URL `path`")
+	fs.Var(aclFlag{dns.ACLAllow}, "allow", "answer clients in `network`, e.g. 192.0.2.0/24; may be repeated")
+	fs.Var(aclFlag{dns.ACLDeny}, "deny", "drop queries from clients in `network` without reply; may be repeated")
+	fs.Var(aclFlag{dns.ACLRefuse}, "refuse", "refuse queries from clients in `network`; may be repeated")
+	fs.Var(logFlag{}, "log", "log `level`: none, error, query or debug")
+	fs.DurationVar(&answers.MinTTL, "minttl", answers.MinTTL, "cache records for at least `duration`")
+	fs.DurationVar(&answers.MaxTTL, "maxttl", answers.MaxTTL, "cache records for at most `duration`; 0 for no limit")
+	fs.DurationVar(&answers.MaxNegativeTTL, "maxnegttl", answers.MaxNegativeTTL, "cache negative answers for at most `duration`; 0 for no limit")
+	fs.DurationVar(&answers.StaleTTL, "stale", answers.StaleTTL, "answer with records up to `duration` past expiry if resolution fails; 0 disables")
+	fs.DurationVar(&staleAnswerTimeout, "staletimeout", staleAnswerTimeout, "answer with stale records if resolution takes longer than `duration`")
+	fs.IntVar(&answers.MaxEntries, "cachesize", answers.MaxEntries, "cache at most `n` answers; 0 for no limit")
+	fs.IntVar(&answers.MaxBytes, "cachemem", answers.MaxBytes, "limit the cache to approximately `bytes` of memory; 0 for no limit")
+	fs.StringVar(&rootHints, "roothints", rootHints, "read root nameserver addresses from `file` instead of the built-in hints")
+	fs.StringVar(&network, "net", network, "contact nameservers over `network` ip4, ip6 or ip for both")
+	fs.StringVar(&qmin, "qmin", qmin, "qname minimisation `mode`: off, strict, or relaxed to fall back to full names on failure")
+	fs.IntVar(&maxQueries, "maxqueries", maxQueries, "send at most `n` queries to nameservers to answer each query")
+	fs.Var(forwardFlag{}, "forward", "send queries for names in `zone=addr,...` to the recursive resolvers at addr; use zone . to forward all queries")
+	fs.Var(forwardFlag{tls: true}, "forwardtls", "like -forward, but using DNS over TLS (`zone=addr,...`)")
+	fs.Var(forwardFlag{stub: true}, "stub", "resolve names in `zone=ip,...` by asking its authoritative nameservers at ip")
+	fs.Var(rpzFlag{}, "rpz", "apply the response policy zone in `zone=file`; may be repeated, earlier zones taking precedence")
+	fs.Var(blocklistFlag{}, "blocklist", "answer NXDOMAIN for the names listed in `file`, one per line or in hosts file format; may be repeated")
+	fs.DurationVar(&policyReload, "policyreload", policyReload, "check policy files for changes every `interval`; 0 disables")
+	fs.Var(localZoneFlag{}, "localzone", "answer names in `zone=type` from local data; type is static, transparent, redirect or refuse")
+	fs.Var(localDataFlag{}, "localdata", "answer with the `record` in master file format, e.g. \"nas.home.arpa. A 192.168.1.10\"; may be repeated")
+	fs.IntVar(&prefetchHits, "prefetch", prefetchHits, "refresh answers requested more than `n` times shortly before they expire; 0 disables")
+	fs.DurationVar(&evictInterval, "evict", evictInterval, "remove expired records from the cache every `interval`")
+}
+
+// listResets holds, for each flag which appends to a setting rather
+// than replacing it, a function clearing the values it adds. Flags
+// whose values decide one another's precedence, such as allow and
+// deny, clear their common setting.
+var listResets = map[string]func(){
+	"listen":      func() { listenAddrs = nil },
+	"listentls":   func() { tlsAddrs = nil },
+	"listenhttps": func() { httpsAddrs = nil },
+	"allow":       func() { clientACL = nil },
+	"deny":        func() { clientACL = nil },
+	"refuse":      func() { clientACL = nil },
+	"forward":     func() { removeForwards(func(fz forwardZone) bool { return !fz.tls && len(fz.stub) == 0 }) },
+	"forwardtls":  func() { removeForwards(func(fz forwardZone) bool { return fz.tls }) },
+	"stub":        func() { removeForwards(func(fz forwardZone) bool { return len(fz.stub) > 0 }) },
+	"rpz":         func() { policyZones.list = nil },
+	"blocklist":   func() { policyZones.list = nil },
+	"localzone":   func() { localData.zones = nil },
+	"localdata":   func() { localData.data = make(map[string][]dnsmessage.Resource) },
+}
+
+// removeForwards removes the forward and stub zones of the kind
+// reported by kind.
+func removeForwards(kind func(forwardZone) bool) {
+	var kept []forwardZone
+	for _, fz := range forwardZones {
+		if !kind(fz) {
+			kept = append(kept, fz)
+		}
+	}
+	forwardZones = kept
+}
+
+// resetLists clears the settings which flags append to.
+func resetLists() {
+	for _, reset := range listResets {
+		reset()
+	}
+	views = nil
+}
+
+// applyConfig applies the settings in the config file name to fs,
+// whose flags have already been parsed from args. Flags set in args
+// take precedence: they are parsed again, replacing the values of the
+// same settings from the file rather than adding to them.
+func applyConfig(name string, fs *flag.FlagSet, args []string) error {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		set = append(set, f.Name)
+	})
+	resetLists()
+	if err := readConfig(name, fs); err != nil {
+		return err
+	}
+	for _, name := range set {
+		if reset, ok := listResets[name]; ok {
+			reset()
+		}
+	}
+	return fs.Parse(args)
+}
+
+func readConfig(name string, fs *flag.FlagSet) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseConfig(f, fs)
+}
+
+// parseConfig reads settings from r, one per line, as a key followed
+// by values. Keys are the names of the flags defined in fs, whose
+// values they set. Keys which may be repeated, such as listen, may
+// also be given several values on one line. Forward and stub zones are
+// configured with their servers separated by spaces rather than commas:
+//
+//	forward corp.example 192.0.2.1 192.0.2.2:5353
+//	forward . 9.9.9.9 tls
+//	stub 10.in-addr.arpa 10.0.0.53
+//
+// Response policy zones are configured with the zone name and file:
+//
+//	rpz rpz.example /etc/recursor/rpz.example.zone
+//
+// Local zones are configured with their name and type, and local data
+// records are written in master file format. Those following a view,
+// named and given its networks, apply only to the view:
+//
+//	localzone home.arpa static
+//	localdata nas.home.arpa. 300 A 192.168.1.10
+//	view office 192.168.1.0/24
+//	localdata intranet.corp.example. A 192.168.1.20
+//
+// Lines starting with # are comments.
+func parseConfig(r io.Reader, fs *flag.FlagSet) error {
+	sc := bufio.NewScanner(r)
+	// local data is for all clients until the first view.
+	view := localData
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // skip config comments
+		}
+		fields := strings.Fields(line)
+		var err error
+		switch fields[0] {
+		case "view":
+			if len(fields) < 2 {
+				err = fmt.Errorf("missing name for view")
+				break
+			}
+			view, err = addView(fields[1], fields[2:])
+		case "localzone":
+			if len(fields) != 3 {
+				err = fmt.Errorf("want zone and type for key %s", fields[0])
+				break
+			}
+			err = view.addZone(fields[1], fields[2])
+		case "localdata":
+			// keep the spacing of quoted strings in the record.
+			err = view.addData(strings.TrimSpace(strings.TrimPrefix(line, "localdata")))
+		default:
+			err = parseSetting(fields, fs)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+func parseSetting(fields []string, fs *flag.FlagSet) error {
+	k := fields[0]
+	if len(fields) < 2 {
+		return fmt.Errorf("missing value for key %s", k)
+	}
+	switch k {
+	case "forward", "stub":
+		if len(fields) < 3 {
+			return fmt.Errorf("missing servers for %s zone %s", k, fields[1])
+		}
+		addrs := fields[2:]
+		var tls bool
+		if k == "forward" && addrs[len(addrs)-1] == "tls" {
+			tls = true
+			addrs = addrs[:len(addrs)-1]
+		}
+		return addForward(fields[1], addrs, tls, k == "stub")
+	case "rpz":
+		if len(fields) != 3 {
+			return fmt.Errorf("want zone and file for key %s", k)
+		}
+		return addPolicyZone(fields[1], fields[2], false)
+	case "listen", "listentls", "listenhttps", "allow", "deny", "refuse", "blocklist":
+		for _, v := range fields[1:] {
+			if err := fs.Set(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "forwardtls", "config":
+		return fmt.Errorf("unknown key %s", k)
+	}
+	if fs.Lookup(k) == nil {
+		return fmt.Errorf("unknown key %s", k)
+	} else if len(fields) > 2 {
+		return fmt.Errorf("too many values for key %s", k)
+	}
+	return fs.Set(k, fields[1])
+}
+
+// validate checks the settings make sense together.
+func validate() error {
+	switch network {
+	case "ip", "ip4", "ip6":
+	default:
+		return fmt.Errorf("unknown network %s", network)
+	}
+	if err := validQmin(qmin); err != nil {
+		return err
+	}
+	if maxQueries < 1 {
+		return fmt.Errorf("maxqueries %d: must be at least 1", maxQueries)
+	}
+	if answers.MaxEntries < 0 || answers.MaxBytes < 0 {
+		return fmt.Errorf("negative cache size")
+	}
+	if answers.MaxTTL > 0 && answers.MinTTL > answers.MaxTTL {
+		return fmt.Errorf("minttl %s greater than maxttl %s", answers.MinTTL, answers.MaxTTL)
+	}
+	if (len(tlsAddrs) > 0 || len(httpsAddrs) > 0) && (certFile == "" || keyFile == "") {
+		return fmt.Errorf("serving DNS over TLS or HTTPS needs a cert and key")
+	}
+	if !strings.HasPrefix(dohPath, "/") {
+		return fmt.Errorf("dohpath %q: must start with /", dohPath)
+	}
+	if policyReload < 0 {
+		return fmt.Errorf("policyreload %s: must not be negative", policyReload)
+	}
+	if evictInterval <= 0 {
+		return fmt.Errorf("evict interval %s: must be positive", evictInterval)
+	}
+	return nil
+}
+
+// listFlag is a flag.Value appending each value to a list.
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.list = append(*f.list, s)
+	return nil
+}
+
+// aclFlag is a flag.Value appending a rule applying action to a
+// network to clientACL. The network is given in CIDR notation; a
+// single address is taken as a network of just that address.
+type aclFlag struct {
+	action dns.ACLAction
+}
+
+func (f aclFlag) String() string {
+	var s []string
+	for _, rule := range clientACL {
+		if rule.Action == f.action {
+			s = append(s, rule.Net.String())
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (f aclFlag) Set(s string) error {
+	n, err := parseNet(s)
+	if err != nil {
+		return err
+	}
+	clientACL = append(clientACL, dns.ACLRule{Net: n, Action: f.action})
+	return nil
+}
+
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+const testConfig = `# a comment
+listen 127.0.0.1:5300 [::1]:5300
+listentls 127.0.0.1 [::1]:8853
+cert cert.pem
+key key.pem
+allow 192.0.2.0/24
+allow 2001:db8::1
+refuse 192.0.2.128/25
+log debug
+maxttl 1h
+cachesize 500
+net ip4
+qmin strict
+forward corp.example 192.0.2.1 192.0.2.2:5353
+forward . 9.9.9.9 tls
+stub 10.in-addr.arpa 10.0.0.53
+rpz rpz.example /etc/recursor/rpz.zone
+blocklist /etc/recursor/ads.hosts /etc/recursor/malware.list
+`
+
+// saveSettings returns a function restoring the settings which may be
+// changed by parsing a config.
+func saveSettings() func() {
+	minTTL, maxTTL, maxNegTTL, staleTTL := answers.MinTTL, answers.MaxTTL, answers.MaxNegativeTTL, answers.StaleTTL
+	entries, bytes := answers.MaxEntries, answers.MaxBytes
+	listen, acl, forward := listenAddrs, clientACL, forwardZones
+	tlsListen, httpsListen, cert, key, path := tlsAddrs, httpsAddrs, certFile, keyFile, dohPath
+	level, nw, mode, hints := logLevel, network, qmin, rootHints
+	queries, prefetch := maxQueries, prefetchHits
+	evict, staleTimeout := evictInterval, staleAnswerTimeout
+	policies, reload := policyZones.list, policyReload
+	restoreLocal := saveLocal()
+	return func() {
+		answers.MinTTL, answers.MaxTTL, answers.MaxNegativeTTL, answers.StaleTTL = minTTL, maxTTL, maxNegTTL, staleTTL
+		answers.MaxEntries, answers.MaxBytes = entries, bytes
+		listenAddrs, clientACL, forwardZones = listen, acl, forward
+		tlsAddrs, httpsAddrs, certFile, keyFile, dohPath = tlsListen, httpsListen, cert, key, path
+		logLevel, network, qmin, rootHints = level, nw, mode, hints
+		maxQueries, prefetchHits = queries, prefetch
+		evictInterval, staleAnswerTimeout = evict, staleTimeout
+		policyZones.list, policyReload = policies, reload
+		restoreLocal()
+	}
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("recursor", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs)
+	return fs
+}
+
+func TestParseConfig(t *testing.T) {
+	defer saveSettings()()
+	resetLists()
+	fs := newFlagSet()
+	// flags take precedence over the file.
+	args := []string{"-cachesize", "1000", "-listen", "127.0.0.1:5301", "-localzone", "lan=static", "-localdata", "router.lan. A 192.168.1.1"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(writeTemp(t, "recursor.conf", testConfig), fs, args); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(listenAddrs) != 1 || listenAddrs[0] != "127.0.0.1:5301" {
+		t.Errorf("got listen addresses %v, want only those from flags", listenAddrs)
+	}
+	if len(tlsAddrs) != 2 || certFile != "cert.pem" || keyFile != "key.pem" {
+		t.Errorf("got tls addresses %v with cert %s key %s", tlsAddrs, certFile, keyFile)
+	}
+	if len(clientACL) != 3 {
+		t.Errorf("got acl %v", clientACL)
+	}
+	acl := append(append(dns.ACL{}, dns.DefaultACL...), clientACL...)
+	clients := map[string]dns.ACLAction{
+		"192.0.2.1":   dns.ACLAllow,
+		"192.0.2.129": dns.ACLRefuse,
+		"2001:db8::1": dns.ACLAllow,
+		"2001:db8::2": dns.ACLRefuse,
+		"10.0.0.1":    dns.ACLAllow,
+	}
+	for addr, want := range clients {
+		if got := acl.Action(net.ParseIP(addr)); got != want {
+			t.Errorf("client %s: got action %s, want %s", addr, got, want)
+		}
+	}
+	if logLevel != logDebug {
+		t.Errorf("got log level %d, want %d", logLevel, logDebug)
+	}
+	if answers.MaxTTL != time.Hour || answers.MaxEntries != 1000 {
+		t.Errorf("got maxttl %s cachesize %d, want 1h and 1000", answers.MaxTTL, answers.MaxEntries)
+	}
+	if network != "ip4" || qmin != qminStrict {
+		t.Errorf("got net %s qmin %s", network, qmin)
+	}
+	if len(forwardZones) != 3 {
+		t.Fatalf("got %d forward zones, want 3", len(forwardZones))
+	}
+	if len(policyZones.list) != 3 || policyZones.list[0].name != "rpz.example." || !policyZones.list[2].blocklist {
+		t.Errorf("got policy zones %v", policyZones.list)
+	}
+	if len(localData.zones) != 1 || len(localData.data["router.lan."]) != 1 {
+		t.Errorf("got local zones %v and data %v", localData.zones, localData.data)
+	}
+	if fz := forwardZones[1]; fz.name.String() != "." || !fz.tls || fz.forwarders[0] != "9.9.9.9:853" {
+		t.Errorf("got forward zone %+v", fz)
+	}
+}
+
+// TestConfigPrecedence checks that settings given both in the config
+// file and as flags are replaced by the flags, not added to.
+func TestConfigPrecedence(t *testing.T) {
+	defer saveSettings()()
+	resetLists()
+	fs := newFlagSet()
+	args := []string{"-forward", "corp.example=192.0.2.9", "-deny", "192.0.2.0/24", "-maxttl", "2h"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(writeTemp(t, "recursor.conf", testConfig), fs, args); err != nil {
+		t.Fatal(err)
+	}
+	// the file's TLS forward and stub zones are kept.
+	if len(forwardZones) != 3 {
+		t.Fatalf("got forward zones %+v, want 3", forwardZones)
+	}
+	for _, name := range []string{"corp.example.", ".", "10.in-addr.arpa."} {
+		fz, ok := findForward(dnsmessage.MustNewName(name))
+		if !ok || fz.name.String() != name {
+			t.Errorf("no forward zone %s in %+v", name, forwardZones)
+		}
+	}
+	if fz, _ := findForward(dnsmessage.MustNewName("corp.example.")); fz.forwarders[0] != "192.0.2.9:domain" {
+		t.Errorf("got corp.example forwarders %v, want those from flags", fz.forwarders)
+	}
+	if len(clientACL) != 1 || clientACL[0].Action != dns.ACLDeny {
+		t.Errorf("got acl %v, want only the rule from flags", clientACL)
+	}
+	if answers.MaxTTL != 2*time.Hour {
+		t.Errorf("got maxttl %s, want 2h", answers.MaxTTL)
+	}
+	// settings only in the file are kept.
+	if len(listenAddrs) != 2 || len(policyZones.list) != 3 {
+		t.Errorf("got listen addresses %v and policy zones %v from file", listenAddrs, policyZones.list)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []string{
+		"bogus 1",
+		"maxttl",
+		"maxttl 1h 2h",
+		"maxttl forever",
+		"cachesize many",
+		"allow 192.0.2.0/33",
+		"deny ::1/129",
+		"log loud",
+		"forward corp.example",
+		"stub 10.in-addr.arpa ns1.example",
+		"config other.conf",
+		"rpz rpz.example",
+		"blocklist a.list\nblocklist a.list",
+	}
+	for _, in := range tests {
+		restore := saveSettings()
+		resetLists()
+		if err := parseConfig(strings.NewReader(in), newFlagSet()); err == nil {
+			t.Errorf("nil error parsing %q", in)
+		}
+		restore()
+	}
+
+	invalid := []string{
+		"net ip5",
+		"qmin sometimes",
+		"maxqueries 0",
+		"minttl 2h\nmaxttl 1h",
+		"listentls :853",
+		"cert cert.pem\nlistenhttps :443",
+		"dohpath dns-query",
+		"policyreload -1s",
+	}
+	for _, in := range invalid {
+		restore := saveSettings()
+		if err := parseConfig(strings.NewReader(in), newFlagSet()); err != nil {
+			t.Errorf("parse %q: %v", in, err)
+		} else if err := validate(); err == nil {
+			t.Errorf("nil error validating %q", in)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+	"olowe.co/dns/cache"
+)
+
+// forwardTimeout is how long to wait for an answer from a forwarder,
+// which may itself need to resolve the name from the root.
+const forwardTimeout = 3 * time.Second
+
+// A forwardZone directs queries for names in a zone to configured
+// servers instead of resolving them from the root nameservers.
+type forwardZone struct {
+	name dnsmessage.Name
+	// forwarders are the addresses, with port, of recursive resolvers
+	// asked to resolve names in the zone on our behalf.
+	forwarders []string
+	// tls is set if forwarders are contacted using DNS over TLS.
+	tls bool
+	// stub lists the authoritative nameservers of the zone, which are
+	// asked iteratively as if we had been referred to them.
+	stub []net.IP
+}
+
+// forwardZones holds the configured forward and stub zones.
+// A forward zone for the root forwards every query.
+var forwardZones []forwardZone
+
+// addForward adds a zone named zone, whose queries are sent to the
+// servers at addrs. If stub is set, addrs are the IP addresses of the
+// zone's authoritative nameservers. Otherwise they are the addresses
+// of forwarders, optionally with a port, contacted using DNS over TLS
+// if tls is set.
+func addForward(zone string, addrs []string, tls, stub bool) error {
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	name, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return fmt.Errorf("zone %s: %w", zone, err)
+	}
+	for _, fz := range forwardZones {
+		if strings.EqualFold(fz.name.String(), name.String()) {
+			return fmt.Errorf("zone %s already configured", name)
+		}
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("zone %s: no servers", name)
+	}
+	fz := forwardZone{name: name, tls: tls}
+	for _, addr := range addrs {
+		if addr == "" {
+			return fmt.Errorf("zone %s: empty server address", name)
+		}
+		if stub {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return fmt.Errorf("stub zone %s: bad nameserver address %q", name, addr)
+			}
+			fz.stub = append(fz.stub, ip)
+			continue
+		}
+		port := "domain"
+		if tls {
+			port = "853"
+		}
+		fz.forwarders = append(fz.forwarders, withPort(addr, port))
+	}
+	forwardZones = append(forwardZones, fz)
+	return nil
+}
+
+// findForward returns the most specific forward or stub zone
+// containing name, if any.
+func findForward(name dnsmessage.Name) (forwardZone, bool) {
+	var best forwardZone
+	var found bool
+	for _, fz := range forwardZones {
+		if dns.IsSubdomain(name, fz.name) && (!found || countLabels(fz.name) > countLabels(best.name)) {
+			best, found = fz, true
+		}
+	}
+	return best, found
+}
+
+// forward asks the forwarders of fz to resolve q, trying each in turn.
+// As with authoritative answers, records outside fz are discarded.
+func forward(q dnsmessage.Question, fz forwardZone, b *budget) (dnsmessage.Message, error) {
+	err := fmt.Errorf("no forwarders")
+	for _, addr := range fz.forwarders {
+		if err := b.charge(); err != nil {
+			return dnsmessage.Message{}, fmt.Errorf("forward %s: %w", q.Name, err)
+		}
+		logf(logDebug, "forwarding %s %s to %s", q.Name, q.Type, addr)
+		var rmsg dnsmessage.Message
+		timeout := forwardTimeout
+		if left := time.Until(b.deadline); !b.deadline.IsZero() && left < timeout {
+			timeout = left
+		}
+		rmsg, err = exchangeForward(q, addr, fz.tls, timeout)
+		if err != nil {
+			continue
+		}
+		switch rmsg.Header.RCode {
+		case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		default:
+			err = fmt.Errorf("%s answered %s", addr, rmsg.Header.RCode)
+			continue
+		}
+		rmsg = sanitise(rmsg, fz.name)
+		cacheAnswer(q, rmsg, cache.CredAnswer)
+		return rmsg, nil
+	}
+	return dnsmessage.Message{}, fmt.Errorf("forward %s: %w", q.Name, err)
+}
+
+// exchangeForward sends q to the recursive resolver at addr, waiting
+// up to timeout for an answer. Answers truncated over UDP are asked
+// for again over TCP.
+func exchangeForward(q dnsmessage.Question, addr string, tls bool, timeout time.Duration) (dnsmessage.Message, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	qmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	if tls {
+		return dns.ExchangeTimeout(qmsg, "tcp-tls", addr, timeout)
+	}
+	rmsg, err := dns.ExchangeTimeout(qmsg, "udp", addr, timeout)
+	if err == nil && rmsg.Header.Truncated {
+		return dns.ExchangeTimeout(qmsg, "tcp", addr, timeout)
+	}
+	return rmsg, err
+}
+
+// forwardFlag is a flag.Value adding forward or stub zones given in
+// the form zone=addr,addr...
+type forwardFlag struct {
+	tls, stub bool
+}
+
+func (f forwardFlag) String() string { return "" }
+
+func (f forwardFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("missing = between zone and servers")
+	}
+	return addForward(s[:i], strings.Split(s[i+1:], ","), f.tls, f.stub)
+}
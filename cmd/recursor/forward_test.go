@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFindForward(t *testing.T) {
+	defer func() { forwardZones = nil }()
+	flags := []struct {
+		f forwardFlag
+		s string
+	}{
+		{forwardFlag{}, "corp.example=192.0.2.1,192.0.2.2:5353"},
+		{forwardFlag{tls: true}, "eng.corp.example.=192.0.2.3"},
+		{forwardFlag{stub: true}, "10.in-addr.arpa=10.0.0.53"},
+	}
+	for _, fl := range flags {
+		if err := fl.f.Set(fl.s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"www.corp.example.", "corp.example."},
+		{"CORP.example.", "corp.example."},
+		{"build.eng.corp.example.", "eng.corp.example."},
+		{"1.0.0.10.in-addr.arpa.", "10.in-addr.arpa."},
+		{"www.example.com.", ""},
+		{"notcorp.example.", ""},
+	}
+	for _, tt := range tests {
+		fz, ok := findForward(dnsmessage.MustNewName(tt.name))
+		if tt.zone == "" {
+			if ok {
+				t.Errorf("%s: got zone %s, want none", tt.name, fz.name)
+			}
+			continue
+		}
+		if !ok || fz.name.String() != tt.zone {
+			t.Errorf("%s: got zone %s, want %s", tt.name, fz.name, tt.zone)
+		}
+	}
+
+	fz, _ := findForward(dnsmessage.MustNewName("corp.example."))
+	if len(fz.forwarders) != 2 || fz.forwarders[0] != "192.0.2.1:domain" || fz.forwarders[1] != "192.0.2.2:5353" {
+		t.Errorf("got forwarders %v", fz.forwarders)
+	}
+	fz, _ = findForward(dnsmessage.MustNewName("eng.corp.example."))
+	if !fz.tls || fz.forwarders[0] != "192.0.2.3:853" {
+		t.Errorf("got TLS forwarders %v", fz.forwarders)
+	}
+	fz, _ = findForward(dnsmessage.MustNewName("10.in-addr.arpa."))
+	if len(fz.stub) != 1 || !fz.stub[0].Equal(net.ParseIP("10.0.0.53")) {
+		t.Errorf("got stub nameservers %v", fz.stub)
+	}
+
+	// forward everything.
+	if err := (forwardFlag{}).Set(".=192.0.2.4"); err != nil {
+		t.Fatal(err)
+	}
+	if fz, ok := findForward(dnsmessage.MustNewName("www.example.com.")); !ok || fz.name.String() != "." {
+		t.Errorf("got zone %s, want root", fz.name)
+	}
+}
+
+func TestAddForwardErrors(t *testing.T) {
+	defer func() { forwardZones = nil }()
+	if err := addForward("dup.example", []string{"192.0.2.1"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	bad := []string{
+		"dup.example.=192.0.2.2", // already configured
+		"nodata.example",         // no servers
+		"empty.example=",
+	}
+	for _, s := range bad {
+		if err := (forwardFlag{}).Set(s); err == nil {
+			t.Errorf("nil error setting %q", s)
+		}
+	}
+	if err := (forwardFlag{stub: true}).Set("stub.example=ns1.stub.example"); err == nil {
+		t.Error("nil error for stub nameserver name instead of address")
+	}
+}
+
+func TestForwardDeadline(t *testing.T) {
+	// a forwarder which never answers.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fz := forwardZone{name: dnsmessage.MustNewName("silent.example."), forwarders: []string{conn.LocalAddr().String()}}
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.silent.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	b := &budget{left: 10, deadline: time.Now().Add(100 * time.Millisecond)}
+	start := time.Now()
+	if _, err := forward(q, fz, b); err == nil {
+		t.Error("nil error from forwarder which never answers")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %s, want about 100ms", d)
+	}
+}
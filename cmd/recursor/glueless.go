@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// maxQueries is the most queries sent to nameservers to answer a
+// single client query, including those to find the addresses of
+// nameservers. It limits the work a client, or a malicious zone,
+// can make us do (BIND uses 100 too).
+var maxQueries = 100
+
+// maxGlueless is the most nameserver names whose addresses are
+// resolved at once for a referral without glue.
+const maxGlueless = 3
+
+var errBudget = errors.New("too many queries")
+
+// A budget is the number of queries left to answer a client query,
+// and the time by which it must be answered. It is shared by
+// concurrent lookups of nameserver addresses.
+type budget struct {
+	left int64
+	// deadline is the zero Time if there is no time limit.
+	deadline time.Time
+	// held holds the questions being resolved with the budget.
+	held keySet
+}
+
+// newBudget returns the budget for a client query, which must be
+// answered within resolveTimeout.
+func newBudget() *budget {
+	return &budget{left: int64(maxQueries), deadline: time.Now().Add(resolveTimeout)}
+}
+
+// spend takes a query from b, reporting whether one was left.
+func (b *budget) spend() bool {
+	return atomic.AddInt64(&b.left, -1) >= 0
+}
+
+// charge takes a query from b, returning errBudget if none was left
+// or errDeadline if the deadline of b has passed.
+func (b *budget) charge() error {
+	if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+		return errDeadline
+	}
+	if !b.spend() {
+		return errBudget
+	}
+	return nil
+}
+
+// nsAddrs returns the addresses of the nameservers in ns, found in
+// the cache or resolved from the root. Up to maxGlueless names are
+// resolved concurrently, for each address type in use, and the first
+// addresses found are returned. Lookups still in progress carry on
+// in the background, caching their answers for later referrals.
+func nsAddrs(ns []dnsmessage.Resource, class dnsmessage.Class, b *budget) []net.IP {
+	var names []dnsmessage.Name
+	for _, r := range ns {
+		if nsr, ok := r.Body.(*dnsmessage.NSResource); ok {
+			names = append(names, nsr.NS)
+		}
+	}
+	for _, name := range names {
+		for _, t := range addrTypes() {
+			if rrs, ok := lookup(name, t); ok {
+				if ips := dns.ExtractIPs(rrs); len(ips) > 0 {
+					return ips
+				}
+			}
+		}
+	}
+
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > maxGlueless {
+			batch = batch[:maxGlueless]
+		}
+		names = names[len(batch):]
+		if ips := resolveAddrs(batch, class, b); len(ips) > 0 {
+			return ips
+		}
+	}
+	return nil
+}
+
+// resolveAddrs concurrently resolves the addresses of names,
+// returning the first found.
+func resolveAddrs(names []dnsmessage.Name, class dnsmessage.Class, b *budget) []net.IP {
+	types := addrTypes()
+	// buffered so that lookups finishing after we return don't block.
+	c := make(chan []net.IP, len(names)*len(types))
+	for _, name := range names {
+		for _, t := range types {
+			go func(q dnsmessage.Question) {
+				rmsg, err := resolveFromRoot(q, b)
+				if err != nil {
+					c <- nil
+					return
+				}
+				c <- dns.ExtractIPs(rmsg.Answers)
+			}(dnsmessage.Question{Name: name, Type: t, Class: class})
+		}
+	}
+	for i := 0; i < cap(c); i++ {
+		if ips := <-c; len(ips) > 0 {
+			return ips
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns/cache"
+)
+
+func TestBudget(t *testing.T) {
+	b := &budget{left: 2}
+	if !b.spend() || !b.spend() {
+		t.Fatal("budget exhausted early")
+	}
+	if b.spend() {
+		t.Error("spent more than budget")
+	}
+
+	// no queries are sent once the budget is spent.
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	_, err := query(q, []net.IP{net.ParseIP("192.0.2.1")}, b)
+	if !errors.Is(err, errBudget) {
+		t.Errorf("got error %v, want %v", err, errBudget)
+	}
+
+	// nor once the deadline has passed.
+	b = &budget{left: 2, deadline: time.Now().Add(-time.Second)}
+	_, err = query(q, []net.IP{net.ParseIP("192.0.2.1")}, b)
+	if !errors.Is(err, errDeadline) {
+		t.Errorf("got error %v, want %v", err, errDeadline)
+	}
+	if b.left != 2 {
+		t.Errorf("%d queries left after deadline, want 2", b.left)
+	}
+}
+
+func TestNSAddrsCached(t *testing.T) {
+	name := dnsmessage.MustNewName("ns2.cached.test.")
+	insert(name, dnsmessage.TypeA, []dnsmessage.Resource{testA(name.String(), 300)}, cache.CredAuthAnswer)
+	ns := []dnsmessage.Resource{testNS("cached.test.", name.String())}
+	// a spent budget shows no queries are needed.
+	ips := nsAddrs(ns, dnsmessage.ClassINET, &budget{})
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got addresses %v, want 192.0.2.1 from cache", ips)
+	}
+}
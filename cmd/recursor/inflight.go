@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// inflightTimeout is how long to wait for another resolution of the
+// same question to complete. A resolution never waits on itself (see
+// keySet), but those of different client queries may still wait on
+// each other while resolving nameserver addresses; the timeout breaks
+// such cycles.
+const inflightTimeout = 5 * time.Second
+
+var errCycle = errors.New("resolution depends on itself")
+
+type inflightKey struct {
+	name  string // lowercase
+	t     dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// A call is a resolution in progress.
+type call struct {
+	done chan struct{}
+	msg  dnsmessage.Message
+	err  error
+}
+
+// A keySet holds the questions being resolved to answer one client
+// query, including those for nameserver addresses. The zero value is
+// an empty set.
+type keySet struct {
+	m map[inflightKey]bool
+	sync.Mutex
+}
+
+// add adds k to s, reporting whether it was not already held.
+func (s *keySet) add(k inflightKey) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.m[k] {
+		return false
+	}
+	if s.m == nil {
+		s.m = make(map[inflightKey]bool)
+	}
+	s.m[k] = true
+	return true
+}
+
+func (s *keySet) remove(k inflightKey) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, k)
+}
+
+var inflight = struct {
+	m map[inflightKey]*call
+	sync.Mutex
+}{m: make(map[inflightKey]*call)}
+
+// dedup calls fn to resolve q unless a resolution of q is already in
+// progress, in which case it waits for and returns that resolution's
+// result instead. Concurrent identical questions are therefore only
+// resolved once. The questions being resolved for the same client
+// query are held in held; as waiting on one of those would be waiting
+// on ourselves, such a question fails at once with errCycle.
+func dedup(q dnsmessage.Question, held *keySet, fn func(dnsmessage.Question) (dnsmessage.Message, error)) (dnsmessage.Message, error) {
+	k := inflightKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+	if !held.add(k) {
+		return dnsmessage.Message{}, fmt.Errorf("resolve %s %s: %w", q.Name, q.Type, errCycle)
+	}
+	defer held.remove(k)
+	inflight.Lock()
+	if c, ok := inflight.m[k]; ok {
+		inflight.Unlock()
+		timer := time.NewTimer(inflightTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.done:
+			return c.msg, c.err
+		case <-timer.C:
+			return dnsmessage.Message{}, fmt.Errorf("resolve %s: timed out waiting for resolution in progress", q.Name)
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	inflight.m[k] = c
+	inflight.Unlock()
+
+	c.msg, c.err = fn(q)
+	inflight.Lock()
+	delete(inflight.m, k)
+	inflight.Unlock()
+	close(c.done)
+	return c.msg, c.err
+}
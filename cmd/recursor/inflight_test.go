@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDedup(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("dedup.example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	var calls int32
+	release := make(chan struct{})
+	fn := func(q dnsmessage.Question) (dnsmessage.Message, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{testA(q.Name.String(), 300)}}, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make(chan dnsmessage.Message, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg, err := dedup(q, new(keySet), fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- msg
+		}()
+	}
+	// give every goroutine the chance to join the first resolution.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+	if calls != 1 {
+		t.Errorf("question resolved %d times, want 1", calls)
+	}
+	for msg := range results {
+		if len(msg.Answers) != 1 {
+			t.Errorf("waiter got %d answers, want 1", len(msg.Answers))
+		}
+	}
+
+	// later questions are resolved afresh.
+	if _, err := dedup(q, new(keySet), fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("question resolved %d times after first completed, want 2", calls)
+	}
+}
+
+func TestDedupCycle(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("cycle.example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	held := new(keySet)
+	var inner error
+	start := time.Now()
+	_, err := dedup(q, held, func(q dnsmessage.Question) (dnsmessage.Message, error) {
+		// as when resolving the address of a nameserver for q needs q.
+		_, inner = dedup(q, held, func(dnsmessage.Question) (dnsmessage.Message, error) {
+			t.Error("question resolved within its own resolution")
+			return dnsmessage.Message{}, nil
+		})
+		return dnsmessage.Message{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(inner, errCycle) {
+		t.Errorf("got error %v, want %v", inner, errCycle)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cycle detected after %s", d)
+	}
+	if len(held.m) != 0 {
+		t.Errorf("questions still held after resolution: %v", held.m)
+	}
+}
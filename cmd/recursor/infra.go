@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// Nameservers we haven't asked yet are assumed to have this RTT,
+// so that they are tried before slow servers but after fast ones.
+// The value is taken from Unbound's infrastructure cache.
+const unknownRTT = 376 * time.Millisecond
+
+// Bounds on the smoothed RTT and the timeouts derived from it.
+const (
+	minTimeout = 100 * time.Millisecond
+	maxTimeout = 5 * time.Second
+	maxRTT     = maxTimeout
+)
+
+// rttWeight is the weight given to the previous smoothed RTT when a
+// new sample is taken, as in BIND.
+const rttWeight = 0.7
+
+// After maxFailures consecutive failures, a nameserver is not asked
+// again until its backoff has passed. The backoff doubles with each
+// further failure, up to maxBackoff.
+const (
+	maxFailures = 3
+	minBackoff  = 5 * time.Second
+	maxBackoff  = 15 * time.Minute
+)
+
+// exploreRate is the probability that a nameserver other than the
+// fastest is asked first, so that changes in latency are noticed.
+const exploreRate = 0.05
+
+type serverInfo struct {
+	srtt     time.Duration
+	failures int
+	backoff  time.Time // not asked until then
+}
+
+// infra holds what we have learned about nameservers, by address.
+var infra = struct {
+	m map[string]*serverInfo
+	sync.Mutex
+	rand *rand.Rand
+}{
+	m:    make(map[string]*serverInfo),
+	rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+func serverStats(ip net.IP) serverInfo {
+	if s, ok := infra.m[ip.String()]; ok {
+		return *s
+	}
+	return serverInfo{srtt: unknownRTT}
+}
+
+// orderServers returns ips ordered by the nameservers' smoothed RTTs,
+// fastest first. Nameservers which have recently failed are moved to
+// the end. Occasionally another server is moved to the front.
+func orderServers(ips []net.IP) []net.IP {
+	return orderServersAt(ips, time.Now())
+}
+
+func orderServersAt(ips []net.IP, now time.Time) []net.IP {
+	infra.Lock()
+	defer infra.Unlock()
+	ordered := make([]net.IP, len(ips))
+	copy(ordered, ips)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := serverStats(ordered[i]), serverStats(ordered[j])
+		abad, bbad := now.Before(a.backoff), now.Before(b.backoff)
+		if abad != bbad {
+			return bbad
+		}
+		return a.srtt < b.srtt
+	})
+	if len(ordered) > 1 && infra.rand.Float64() < exploreRate {
+		i := 1 + infra.rand.Intn(len(ordered)-1)
+		if !now.Before(serverStats(ordered[i]).backoff) {
+			ordered[0], ordered[i] = ordered[i], ordered[0]
+		}
+	}
+	return ordered
+}
+
+// serverTimeout returns how long to wait for a reply from ip,
+// scaled to its measured latency.
+func serverTimeout(ip net.IP) time.Duration {
+	infra.Lock()
+	srtt := serverStats(ip).srtt
+	infra.Unlock()
+	timeout := 4 * srtt
+	if timeout < minTimeout {
+		return minTimeout
+	} else if timeout > maxTimeout {
+		return maxTimeout
+	}
+	return timeout
+}
+
+// recordRTT updates the smoothed RTT of ip with a new sample
+// and clears its failures.
+func recordRTT(ip net.IP, rtt time.Duration) {
+	infra.Lock()
+	defer infra.Unlock()
+	s, ok := infra.m[ip.String()]
+	if !ok {
+		infra.m[ip.String()] = &serverInfo{srtt: rtt}
+		return
+	}
+	s.srtt = time.Duration(rttWeight*float64(s.srtt) + (1-rttWeight)*float64(rtt))
+	s.failures = 0
+	s.backoff = time.Time{}
+}
+
+// recordFailure notes that ip timed out or gave a useless (lame)
+// answer, doubling its smoothed RTT and backing off from it after
+// repeated failures.
+func recordFailure(ip net.IP) {
+	recordFailureAt(ip, time.Now())
+}
+
+func recordFailureAt(ip net.IP, now time.Time) {
+	infra.Lock()
+	defer infra.Unlock()
+	s, ok := infra.m[ip.String()]
+	if !ok {
+		s = &serverInfo{srtt: unknownRTT}
+		infra.m[ip.String()] = s
+	}
+	s.failures++
+	s.srtt *= 2
+	if s.srtt > maxRTT {
+		s.srtt = maxRTT
+	}
+	if s.failures >= maxFailures {
+		backoff := minBackoff << (s.failures - maxFailures)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		s.backoff = now.Add(backoff)
+	}
+}
+
+// ask sends q to the nameserver at ip, recording how long it took to
+// answer or whether it failed. No answer is waited for past deadline,
+// unless it is the zero Time.
+func ask(q dnsmessage.Question, ip net.IP, deadline time.Time) (dnsmessage.Message, error) {
+	start := time.Now()
+	timeout := serverTimeout(ip)
+	cut := false
+	if !deadline.IsZero() {
+		left := deadline.Sub(start)
+		if left <= 0 {
+			return dnsmessage.Message{}, errDeadline
+		}
+		if left < timeout {
+			timeout, cut = left, true
+		}
+	}
+	rmsg, err := dns.AskTimeout(q, udpNetwork(ip), ip2dial(ip), timeout)
+	if err != nil && cut {
+		// not the server's fault that we stopped waiting early.
+		return rmsg, err
+	}
+	if err != nil || lame(rmsg) {
+		recordFailure(ip)
+		return rmsg, err
+	}
+	recordRTT(ip, time.Since(start))
+	return rmsg, nil
+}
+
+// lame reports whether rmsg shows its nameserver cannot answer for the
+// zone it was asked about.
+func lame(rmsg dnsmessage.Message) bool {
+	switch rmsg.Header.RCode {
+	case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused, dnsmessage.RCodeNotImplemented:
+		return true
+	}
+	return false
+}
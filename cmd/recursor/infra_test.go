@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOrderServers(t *testing.T) {
+	fast := net.ParseIP("192.0.2.1")
+	slow := net.ParseIP("192.0.2.2")
+	unknown := net.ParseIP("192.0.2.3")
+	failing := net.ParseIP("192.0.2.4")
+	recordRTT(fast, 10*time.Millisecond)
+	recordRTT(slow, time.Second)
+	now := time.Now()
+	for i := 0; i < maxFailures; i++ {
+		recordFailureAt(failing, now)
+	}
+	want := []net.IP{fast, unknown, slow, failing}
+
+	// exploration occasionally reorders servers; most orderings
+	// must be by RTT.
+	var matched int
+	for i := 0; i < 100; i++ {
+		got := orderServersAt([]net.IP{failing, slow, unknown, fast}, now)
+		if equalIPs(got, want) {
+			matched++
+		}
+		if !got[len(got)-1].Equal(failing) {
+			t.Fatalf("backed off server not last: %v", got)
+		}
+	}
+	if matched < 80 {
+		t.Errorf("servers ordered by RTT %d times in 100", matched)
+	}
+	// once the backoff has passed, the server may be asked again.
+	got := orderServersAt([]net.IP{failing, slow}, now.Add(maxBackoff))
+	if !got[0].Equal(slow) && !got[0].Equal(failing) {
+		t.Errorf("unexpected order %v", got)
+	}
+}
+
+func TestRecordRTT(t *testing.T) {
+	ip := net.ParseIP("192.0.2.10")
+	recordRTT(ip, 100*time.Millisecond)
+	recordRTT(ip, 200*time.Millisecond)
+	infra.Lock()
+	srtt := serverStats(ip).srtt
+	infra.Unlock()
+	if want := 130 * time.Millisecond; srtt != want {
+		t.Errorf("srtt %s, want %s", srtt, want)
+	}
+	if timeout := serverTimeout(ip); timeout != 4*srtt {
+		t.Errorf("timeout %s, want %s", timeout, 4*srtt)
+	}
+
+	recordFailure(ip)
+	infra.Lock()
+	s := serverStats(ip)
+	infra.Unlock()
+	if s.srtt != 2*srtt || s.failures != 1 {
+		t.Errorf("after failure got srtt %s and %d failures, want %s and 1", s.srtt, s.failures, 2*srtt)
+	}
+	recordRTT(ip, 100*time.Millisecond)
+	infra.Lock()
+	s = serverStats(ip)
+	infra.Unlock()
+	if s.failures != 0 {
+		t.Errorf("%d failures after answer, want 0", s.failures)
+	}
+}
+
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
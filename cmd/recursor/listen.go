@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// dohPath is the URL path at which DNS over HTTPS queries are answered.
+var dohPath = "/dns-query"
+
+// serveAll starts serving queries on each configured address. Every
+// transport is answered by the same handler, so shares one cache, and
+// subject to the same access control. The first error from any
+// listener is sent on the returned channel.
+func serveAll() (<-chan error, error) {
+	acl := append(append(dns.ACL{}, dns.DefaultACL...), clientACL...)
+	h := acl.Handler(viewHandlers().Handler(handler))
+	addrs := listenAddrs
+	if len(addrs) == 0 && len(tlsAddrs) == 0 && len(httpsAddrs) == 0 {
+		addrs = []string{defaultListenAddr}
+	}
+	var config *tls.Config
+	if len(tlsAddrs) > 0 || len(httpsAddrs) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate: %w", err)
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	errc := make(chan error, 2*len(addrs)+len(tlsAddrs)+len(httpsAddrs))
+	serve := func(network, addr string, fn func() error) {
+		go func() {
+			errc <- fmt.Errorf("serve %s %s: %w", network, addr, fn())
+		}()
+	}
+	for _, addr := range addrs {
+		addr := addr
+		for _, network := range []string{"udp", "tcp"} {
+			network := network
+			serve(network, addr, func() error {
+				return dns.ListenAndServe(network, addr, h)
+			})
+		}
+	}
+	for _, addr := range tlsAddrs {
+		addr := withPort(addr, "853")
+		serve("tls", addr, func() error {
+			l, err := tls.Listen("tcp", addr, config.Clone())
+			if err != nil {
+				return err
+			}
+			return dns.Serve(l, h)
+		})
+	}
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler(h))
+	for _, addr := range httpsAddrs {
+		srv := &http.Server{Addr: withPort(addr, "443"), Handler: mux, TLSConfig: config.Clone()}
+		serve("https", srv.Addr, func() error {
+			return srv.ListenAndServeTLS("", "")
+		})
+	}
+	return errc, nil
+}
+
+// withPort returns addr with port appended if it has none.
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// dohHandler returns an http.Handler answering DNS over HTTPS
+// requests (RFC 8484) with h. Requests carry the query either as the
+// body of a POST or base64url-encoded in the dns parameter of a GET.
+// Queries which h drops without reply are answered 403 Forbidden.
+func dohHandler(h dns.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		serveDoH(w, req, h)
+	}
+}
+
+func serveDoH(w http.ResponseWriter, req *http.Request, h dns.Handler) {
+	var b []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, "decode dns parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); ct != dns.MediaType {
+			http.Error(w, fmt.Sprintf("unsupported media type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(req.Body, int64(dns.MaxMsgSize)+1))
+		if err != nil {
+			http.Error(w, "read query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(b) > dns.MaxMsgSize {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, fmt.Sprintf("method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var qmsg dnsmessage.Message
+	if err := qmsg.Unpack(b); err != nil {
+		http.Error(w, "unpack query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw := &httpResponse{w: w, raddr: httpRemoteAddr(req)}
+	h(rw, &qmsg)
+	if !rw.written {
+		http.Error(w, "query dropped", http.StatusForbidden)
+	}
+}
+
+// httpResponse is a dns.ResponseWriter writing replies as the body
+// of a DNS over HTTPS response.
+type httpResponse struct {
+	w       http.ResponseWriter
+	raddr   net.Addr
+	written bool
+}
+
+func (r *httpResponse) Write(p []byte) (int, error) {
+	r.written = true
+	r.w.Header().Set("Content-Type", dns.MediaType)
+	r.w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+	return r.w.Write(p)
+}
+
+// WriteMsg writes msg, letting HTTP caches keep it for as long as the
+// shortest TTL of its records.
+func (r *httpResponse) WriteMsg(msg dnsmessage.Message) error {
+	b, err := msg.Pack()
+	if err != nil {
+		r.written = true
+		http.Error(r.w, "pack reply: "+err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if ttl, ok := leastTTL(msg); ok {
+		r.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	_, err = r.Write(b)
+	return err
+}
+
+// RemoteAddr returns the address of the client which sent the request.
+func (r *httpResponse) RemoteAddr() net.Addr {
+	return r.raddr
+}
+
+// httpRemoteAddr returns the address of the client which sent req,
+// or nil if it cannot be parsed.
+func httpRemoteAddr(req *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// leastTTL returns the smallest TTL of the records in msg, ignoring
+// the OPT pseudo-record. It returns false if msg has no records.
+func leastTTL(msg dnsmessage.Message) (uint32, bool) {
+	var least uint32
+	var found bool
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range section {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || r.Header.TTL < least {
+				least, found = r.Header.TTL, true
+			}
+		}
+	}
+	return least, found
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+func TestServeDoH(t *testing.T) {
+	// without recursion desired, the query is refused before resolving.
+	qmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := qmsg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	post := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(b))
+	post.Header.Set("Content-Type", dns.MediaType)
+	for _, req := range []*http.Request{get, post} {
+		w := httptest.NewRecorder()
+		serveDoH(w, req, handler)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", req.Method, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != dns.MediaType {
+			t.Errorf("%s: got content type %q", req.Method, ct)
+		}
+		var rmsg dnsmessage.Message
+		if err := rmsg.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("%s: unpack reply: %v", req.Method, err)
+		}
+		if rmsg.Header.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("%s: got rcode %s, want %s", req.Method, rmsg.Header.RCode, dnsmessage.RCodeRefused)
+		}
+	}
+
+	badType := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(b))
+	badType.Header.Set("Content-Type", "text/plain")
+	bad := map[*http.Request]int{
+		httptest.NewRequest(http.MethodGet, dohPath+"?dns=!!", nil): http.StatusBadRequest,
+		httptest.NewRequest(http.MethodGet, dohPath, nil):           http.StatusBadRequest,
+		badType: http.StatusUnsupportedMediaType,
+		httptest.NewRequest(http.MethodPut, dohPath, bytes.NewReader(b)): http.StatusMethodNotAllowed,
+	}
+	for req, want := range bad {
+		w := httptest.NewRecorder()
+		serveDoH(w, req, handler)
+		if w.Code != want {
+			t.Errorf("%s %s: got status %d, want %d", req.Method, req.URL, w.Code, want)
+		}
+	}
+}
+
+func TestDoHDenied(t *testing.T) {
+	// httptest requests come from 192.0.2.1.
+	acl := dns.ACL{{Net: &net.IPNet{IP: net.IPv4(192, 0, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}, Action: dns.ACLDeny}}
+	w := httptest.NewRecorder()
+	dohHandler(acl.Handler(handler)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, dohPath+"?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestLeastTTL(t *testing.T) {
+	rr := func(ttl uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{},
+		}
+	}
+	msg := dnsmessage.Message{Answers: []dnsmessage.Resource{rr(300), rr(60)}, Authorities: []dnsmessage.Resource{rr(3600)}}
+	if ttl, ok := leastTTL(msg); !ok || ttl != 60 {
+		t.Errorf("got ttl %d %v, want 60", ttl, ok)
+	}
+	if _, ok := leastTTL(dnsmessage.Message{}); ok {
+		t.Error("found ttl in empty message")
+	}
+}
+
+func TestWithPort(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":     "192.0.2.1:853",
+		"192.0.2.1:53":  "192.0.2.1:53",
+		":853":          ":853",
+		"2001:db8::1":   "[2001:db8::1]:853",
+		"[2001:db8::1]": "[2001:db8::1]:853",
+		"dns.example":   "dns.example:853",
+	}
+	for in, want := range tests {
+		if got := withPort(in, "853"); got != want {
+			t.Errorf("withPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTruncateUDP(t *testing.T) {
+	name := dnsmessage.MustNewName("big.example.")
+	big := func(w dns.ResponseWriter, qmsg *dnsmessage.Message) {
+		rmsg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: qmsg.Header.ID, Response: true},
+			Questions: qmsg.Questions,
+		}
+		for i := 0; i < 64; i++ {
+			rmsg.Answers = append(rmsg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+			})
+		}
+		w.WriteMsg(rmsg)
+	}
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	go dns.ServePacket(pconn, big)
+
+	q := dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{Header: dnsmessage.Header{ID: 1}, Questions: []dnsmessage.Question{q}}
+	rmsg, err := dns.Exchange(qmsg, pconn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rmsg.Header.Truncated {
+		t.Error("oversized reply not truncated")
+	}
+	if len(rmsg.Answers) > 0 {
+		t.Errorf("got %d answers in truncated reply", len(rmsg.Answers))
+	}
+
+	// the full reply is sent over TCP.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go dns.Serve(l, big)
+	rmsg, err = dns.ExchangeTCP(qmsg, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rmsg.Header.Truncated || len(rmsg.Answers) != 64 {
+		t.Errorf("got truncated %v with %d answers over tcp, want all 64", rmsg.Header.Truncated, len(rmsg.Answers))
+	}
+}
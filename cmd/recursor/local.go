@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// Types of local zones, which decide how queries for names in the zone
+// without matching local data are answered.
+const (
+	localStatic      = iota // answer NXDOMAIN or NODATA
+	localTransparent        // resolve as usual
+	localRedirect           // answer names without local data of their own with that of the zone's apex
+	localRefuse             // answer REFUSED
+)
+
+var localTypes = []string{"static", "transparent", "redirect", "refuse"}
+
+// localTTL is the TTL of local data records given without one.
+const localTTL = 3600
+
+type localZone struct {
+	name dnsmessage.Name
+	typ  int
+}
+
+// A localView holds local zones and the records answered for them,
+// in place of resolving, to the clients in its networks.
+type localView struct {
+	name  string
+	nets  []*net.IPNet
+	zones []localZone
+	// data holds records by lower-case owner name.
+	data map[string][]dnsmessage.Resource
+}
+
+func newLocalView(name string) *localView {
+	return &localView{name: name, data: make(map[string][]dnsmessage.Resource)}
+}
+
+var (
+	// localData is the local data answered to all clients.
+	localData = newLocalView("")
+	// views hold local data answered only to clients in their
+	// networks, before that of localData.
+	views []*localView
+)
+
+// addView adds a view, named name, for the clients in nets.
+func addView(name string, nets []string) (*localView, error) {
+	for _, v := range views {
+		if v.name == name {
+			return nil, fmt.Errorf("view %s already configured", name)
+		}
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("view %s: no networks", name)
+	}
+	v := newLocalView(name)
+	for _, s := range nets {
+		n, err := parseNet(s)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+		v.nets = append(v.nets, n)
+	}
+	views = append(views, v)
+	return v, nil
+}
+
+// addZone adds the local zone name, of the type named typ.
+func (v *localView) addZone(name, typ string) error {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return fmt.Errorf("local zone %s: %w", name, err)
+	}
+	for _, z := range v.zones {
+		if strings.EqualFold(z.name.String(), name) {
+			return fmt.Errorf("local zone %s already configured", name)
+		}
+	}
+	for i, t := range localTypes {
+		if typ == t {
+			v.zones = append(v.zones, localZone{name: n, typ: i})
+			return nil
+		}
+	}
+	return fmt.Errorf("local zone %s: unknown type %q", name, typ)
+}
+
+// addData adds the record rr, written in master file format with its
+// owner name, such as "nas.home.arpa. A 192.168.1.10".
+func (v *localView) addData(rr string) error {
+	rrs, err := readResources(strings.NewReader(fmt.Sprintf("$TTL %d\n%s", localTTL, rr)), rootName)
+	if err != nil {
+		return fmt.Errorf("local data %q: %w", rr, err)
+	}
+	if len(rrs) != 1 {
+		return fmt.Errorf("local data %q: want one record, got %d", rr, len(rrs))
+	}
+	k := strings.ToLower(rrs[0].Header.Name.String())
+	v.data[k] = append(v.data[k], rrs[0])
+	return nil
+}
+
+// zone returns the closest local zone of v enclosing name.
+func (v *localView) zone(name dnsmessage.Name) (localZone, bool) {
+	var best localZone
+	var found bool
+	for _, z := range v.zones {
+		if dns.IsSubdomain(name, z.name) && (!found || countLabels(z.name) > countLabels(best.name)) {
+			best, found = z, true
+		}
+	}
+	return best, found
+}
+
+// answer returns the answer to q from the local zones and data of v,
+// and whether q is answered locally. Records for a name outside any
+// local zone are answered as if from a transparent zone.
+func (v *localView) answer(q dnsmessage.Question) (dnsmessage.Message, bool) {
+	var rmsg dnsmessage.Message
+	rmsg.Header.Authoritative = true
+	z, ok := v.zone(q.Name)
+	rrs, named := v.data[strings.ToLower(q.Name.String())]
+	if !named && ok && z.typ == localRedirect {
+		rrs, named = v.data[strings.ToLower(z.name.String())]
+	}
+	if !ok {
+		if !named {
+			return rmsg, false
+		}
+		z.typ = localTransparent
+	}
+
+	if named {
+		for _, rr := range rrs {
+			if rr.Header.Type == q.Type || rr.Header.Type == dnsmessage.TypeCNAME {
+				rr.Header.Name = q.Name
+				rmsg.Answers = append(rmsg.Answers, rr)
+			}
+		}
+		if len(rmsg.Answers) == 0 {
+			rmsg.Authorities = v.soa(z)
+		}
+		return rmsg, true
+	}
+	switch z.typ {
+	case localStatic, localRedirect:
+		rmsg.Header.RCode = dnsmessage.RCodeNameError
+		if v.hasDataBelow(q.Name) {
+			rmsg.Header.RCode = dnsmessage.RCodeSuccess
+		}
+		rmsg.Authorities = v.soa(z)
+		return rmsg, true
+	case localRefuse:
+		rmsg.Header.Authoritative = false
+		rmsg.Header.RCode = dnsmessage.RCodeRefused
+		return rmsg, true
+	}
+	return rmsg, false
+}
+
+// soa returns the SOA record in the local data of zone z, if any.
+func (v *localView) soa(z localZone) []dnsmessage.Resource {
+	return filterRRs(v.data[strings.ToLower(z.name.String())], z.name, dnsmessage.TypeSOA)
+}
+
+// hasDataBelow reports whether v holds records for a subdomain of
+// name, which therefore exists even without records of its own.
+func (v *localView) hasDataBelow(name dnsmessage.Name) bool {
+	suffix := "." + strings.ToLower(name.String())
+	for k := range v.data {
+		if strings.HasSuffix(k, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// localAnswer returns the local answer to q from view v, if not nil,
+// then from the local data for all clients. A local zone of v takes
+// precedence over those for all clients, so a transparent zone in a
+// view resolves names which are otherwise answered locally.
+func localAnswer(q dnsmessage.Question, v *localView) (dnsmessage.Message, bool) {
+	if v != nil {
+		if rmsg, ok := v.answer(q); ok {
+			return rmsg, true
+		}
+		if _, ok := v.zone(q.Name); ok {
+			return dnsmessage.Message{}, false
+		}
+	}
+	return localData.answer(q)
+}
+
+// viewHandlers returns the views as dns.Views, each answering from
+// its local data before that for all clients.
+func viewHandlers() dns.Views {
+	var vs dns.Views
+	for _, v := range views {
+		v := v
+		vs = append(vs, dns.View{
+			Name: v.name,
+			Nets: v.nets,
+			Handler: func(w dns.ResponseWriter, qmsg *dnsmessage.Message) {
+				answerQuery(w, qmsg, v)
+			},
+		})
+	}
+	return vs
+}
+
+// localZoneFlag is a flag.Value adding a local zone for all clients
+// given in the form zone=type.
+type localZoneFlag struct{}
+
+func (localZoneFlag) String() string { return "" }
+
+func (localZoneFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("missing = between zone and type")
+	}
+	return localData.addZone(s[:i], s[i+1:])
+}
+
+// localDataFlag is a flag.Value adding a local data record for all
+// clients.
+type localDataFlag struct{}
+
+func (localDataFlag) String() string { return "" }
+
+func (localDataFlag) Set(s string) error {
+	return localData.addData(s)
+}
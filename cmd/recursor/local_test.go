@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testLocal = `localzone home.arpa static
+localdata home.arpa. SOA ns.home.arpa. hostmaster.home.arpa. 1 3600 600 86400 60
+localdata nas.home.arpa. 300 A 192.168.1.10
+localdata printer.office.home.arpa. A 192.168.1.11
+localdata txt.home.arpa. TXT "two  spaces"
+localzone ads.example redirect
+localdata ads.example. A 0.0.0.0
+localdata mail.ads.example. A 192.0.2.25
+localzone blocked.example refuse
+localzone corp.example transparent
+localdata wiki.corp.example. A 192.0.2.80
+localdata router.lan. A 192.168.1.1
+localzone intranet.example static
+view office 192.168.1.0/24
+localdata wiki.corp.example. A 192.168.1.80
+localzone secret.corp.example static
+localzone intranet.example transparent
+`
+
+// saveLocal returns a function restoring the local data and views.
+func saveLocal() func() {
+	data, vs := localData, views
+	return func() {
+		localData, views = data, vs
+	}
+}
+
+func TestLocalAnswer(t *testing.T) {
+	defer saveLocal()()
+	localData, views = newLocalView(""), nil
+	if err := parseConfig(strings.NewReader(testLocal), newFlagSet()); err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 1 {
+		t.Fatalf("got %d views, want 1", len(views))
+	}
+	office := views[0]
+
+	tests := []struct {
+		name      string
+		typ       dnsmessage.Type
+		view      *localView
+		local     bool
+		rcode     dnsmessage.RCode
+		answers   int
+		authority bool
+	}{
+		{"nas.home.arpa.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"NAS.home.arpa.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"nas.home.arpa.", dnsmessage.TypeAAAA, nil, true, dnsmessage.RCodeSuccess, 0, true},
+		{"txt.home.arpa.", dnsmessage.TypeTXT, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"missing.home.arpa.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeNameError, 0, true},
+		{"office.home.arpa.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 0, true},
+		{"www.ads.example.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"www.ads.example.", dnsmessage.TypeAAAA, nil, true, dnsmessage.RCodeSuccess, 0, false},
+		{"www.blocked.example.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeRefused, 0, false},
+		{"wiki.corp.example.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"www.corp.example.", dnsmessage.TypeA, nil, false, 0, 0, false},
+		{"router.lan.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"www.example.", dnsmessage.TypeA, nil, false, 0, 0, false},
+		{"wiki.corp.example.", dnsmessage.TypeA, office, true, dnsmessage.RCodeSuccess, 1, false},
+		{"x.secret.corp.example.", dnsmessage.TypeA, office, true, dnsmessage.RCodeNameError, 0, false},
+		{"x.secret.corp.example.", dnsmessage.TypeA, nil, false, 0, 0, false},
+		{"nas.home.arpa.", dnsmessage.TypeA, office, true, dnsmessage.RCodeSuccess, 1, false},
+		{"mail.ads.example.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeSuccess, 1, false},
+		{"www.intranet.example.", dnsmessage.TypeA, nil, true, dnsmessage.RCodeNameError, 0, false},
+		{"www.intranet.example.", dnsmessage.TypeA, office, false, 0, 0, false},
+	}
+	for _, tt := range tests {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(tt.name), Type: tt.typ, Class: dnsmessage.ClassINET}
+		rmsg, ok := localAnswer(q, tt.view)
+		if ok != tt.local {
+			t.Errorf("%s %s: answered locally %v, want %v", tt.name, tt.typ, ok, tt.local)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rmsg.Header.RCode != tt.rcode || len(rmsg.Answers) != tt.answers || (len(rmsg.Authorities) > 0) != tt.authority {
+			t.Errorf("%s %s: got %s with %d answers and %d authorities", tt.name, tt.typ, rmsg.Header.RCode, len(rmsg.Answers), len(rmsg.Authorities))
+		}
+		for _, rr := range rmsg.Answers {
+			if rr.Header.Name.String() != tt.name {
+				t.Errorf("%s %s: answer owned by %s", tt.name, tt.typ, rr.Header.Name)
+			}
+		}
+	}
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("wiki.corp.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rmsg, _ := localAnswer(q, office)
+	if a := rmsg.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "192.168.1.80" {
+		t.Errorf("office view answered %s", net.IP(a.A[:]))
+	}
+	// in a redirect zone, a name's own data is answered before the apex's.
+	q.Name = dnsmessage.MustNewName("mail.ads.example.")
+	rmsg, _ = localAnswer(q, nil)
+	if a := rmsg.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "192.0.2.25" {
+		t.Errorf("redirect zone answered %s for name with own data", net.IP(a.A[:]))
+	}
+	q.Name = dnsmessage.MustNewName("txt.home.arpa.")
+	q.Type = dnsmessage.TypeTXT
+	rmsg, _ = localAnswer(q, nil)
+	if txt := rmsg.Answers[0].Body.(*dnsmessage.TXTResource); txt.TXT[0] != "two  spaces" {
+		t.Errorf("got txt %q", txt.TXT)
+	}
+}
+
+// addrWriter is a msgWriter for queries from raddr.
+type addrWriter struct {
+	msgWriter
+	raddr net.Addr
+}
+
+func (w *addrWriter) RemoteAddr() net.Addr { return w.raddr }
+
+func TestViewHandlers(t *testing.T) {
+	defer saveLocal()()
+	localData, views = newLocalView(""), nil
+	if err := parseConfig(strings.NewReader(testLocal), newFlagSet()); err != nil {
+		t.Fatal(err)
+	}
+	h := viewHandlers().Handler(handler)
+	qmsg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("wiki.corp.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	clients := map[string]string{
+		"192.168.1.5": "192.168.1.80",
+		"10.0.0.5":    "192.0.2.80",
+	}
+	for client, want := range clients {
+		w := &addrWriter{raddr: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		h(w, qmsg)
+		if len(w.msgs) != 1 || len(w.msgs[0].Answers) != 1 {
+			t.Fatalf("%s: got replies %v", client, w.msgs)
+		}
+		rmsg := w.msgs[0]
+		if a := rmsg.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != want || rmsg.Header.ID != 1 || !rmsg.Header.Authoritative {
+			t.Errorf("%s: got %s in %+v, want %s", client, net.IP(a.A[:]), rmsg.Header, want)
+		}
+	}
+}
+
+func TestLocalErrors(t *testing.T) {
+	tests := []string{
+		"localzone home.arpa",
+		"localzone home.arpa private",
+		"localzone home.arpa static\nlocalzone HOME.arpa. static",
+		"localdata nas.home.arpa. A 192.168.1",
+		"localdata nas.home.arpa. A",
+		"view office",
+		"view office 192.168.1.0/24\nview office 10.0.0.0/8",
+		"view office office.example",
+	}
+	for _, in := range tests {
+		restore := saveLocal()
+		localData, views = newLocalView(""), nil
+		if err := parseConfig(strings.NewReader(in), newFlagSet()); err == nil {
+			t.Errorf("nil error parsing %q", in)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Log levels, from least to most verbose.
+const (
+	logNone  = iota
+	logError // failures to resolve and other errors
+	logQuery // every client query and its response code
+	logDebug // each step of resolution
+)
+
+var logLevels = []string{"none", "error", "query", "debug"}
+
+// logLevel is the most verbose level of messages written to the log.
+var logLevel = logError
+
+// logf writes a message to standard error if level is enabled.
+func logf(level int, format string, v ...interface{}) {
+	if level <= logLevel {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+	}
+}
+
+// logFlag is a flag.Value setting logLevel by name.
+type logFlag struct{}
+
+func (logFlag) String() string {
+	if logLevel >= 0 && logLevel < len(logLevels) {
+		return logLevels[logLevel]
+	}
+	return ""
+}
+
+func (logFlag) Set(s string) error {
+	for i, name := range logLevels {
+		if s == name {
+			logLevel = i
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", s)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QNAME minimisation modes (RFC 9156).
+const (
+	qminOff     = "off"     // always send the full query name
+	qminStrict  = "strict"  // never send more of the name than needed
+	qminRelaxed = "relaxed" // send the full name if minimised queries fail
+)
+
+// qmin is the QNAME minimisation mode in use.
+var qmin = qminRelaxed
+
+// qminType is the type of minimised queries. RFC 9156 section 2.1
+// prefers A to NS as some authoritative servers mishandle NS queries.
+const qminType = dnsmessage.TypeA
+
+// maxMinimise limits the number of minimised queries sent to the
+// servers of a zone, bounding the cost of names with many labels.
+// After that the full query name is sent. See RFC 9156 section 2.3.
+const maxMinimise = 10
+
+// countLabels returns the number of labels in name.
+// The root has no labels.
+func countLabels(name dnsmessage.Name) int {
+	s := strings.TrimSuffix(name.String(), ".")
+	if s == "" {
+		return 0
+	}
+	return strings.Count(s, ".") + 1
+}
+
+// ancestor returns the name formed by the last n labels of name.
+func ancestor(name dnsmessage.Name, n int) dnsmessage.Name {
+	labels := strings.Split(strings.TrimSuffix(name.String(), "."), ".")
+	if n <= 0 {
+		return rootName
+	} else if n >= len(labels) {
+		return name
+	}
+	return dnsmessage.MustNewName(strings.Join(labels[len(labels)-n:], ".") + ".")
+}
+
+// minimise returns the question to ask the nameservers of zone while
+// resolving q, revealing only the next n labels of its name below the
+// zone. If the question cannot be minimised, q is returned.
+func minimise(q dnsmessage.Question, zone dnsmessage.Name, n int) (dnsmessage.Question, bool) {
+	if qmin == qminOff || n > maxMinimise {
+		return q, false
+	}
+	labels := countLabels(zone) + n
+	if labels >= countLabels(q.Name) {
+		return q, false
+	}
+	return dnsmessage.Question{Name: ancestor(q.Name, labels), Type: qminType, Class: q.Class}, true
+}
+
+// isReferral reports whether rmsg refers us to the nameservers of
+// another zone.
+func isReferral(rmsg dnsmessage.Message) bool {
+	if rmsg.Header.Authoritative || rmsg.Header.RCode != dnsmessage.RCodeSuccess || len(rmsg.Answers) > 0 {
+		return false
+	}
+	for _, r := range rmsg.Authorities {
+		if r.Header.Type == dnsmessage.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+func validQmin(mode string) error {
+	switch mode {
+	case qminOff, qminStrict, qminRelaxed:
+		return nil
+	}
+	return fmt.Errorf("unknown qname minimisation mode %q", mode)
+}
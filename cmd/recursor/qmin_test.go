@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMinimise(t *testing.T) {
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("a.b.www.example.com."),
+		Type:  dnsmessage.TypeAAAA,
+		Class: dnsmessage.ClassINET,
+	}
+	tests := []struct {
+		zone string
+		n    int
+		want string
+	}{
+		{".", 1, "com."},
+		{".", 2, "example.com."},
+		{"com.", 1, "example.com."},
+		{"example.com.", 1, "www.example.com."},
+		{"example.com.", 2, "b.www.example.com."},
+		{"example.com.", 3, ""},
+		{"www.example.com.", 2, ""},
+	}
+	for _, tt := range tests {
+		mq, minimised := minimise(q, dnsmessage.MustNewName(tt.zone), tt.n)
+		if tt.want == "" {
+			if minimised || mq != q {
+				t.Errorf("zone %s label %d: got minimised question %s %s, want full question", tt.zone, tt.n, mq.Name, mq.Type)
+			}
+			continue
+		}
+		if !minimised || mq.Name.String() != tt.want || mq.Type != qminType {
+			t.Errorf("zone %s label %d: got %s %s, want %s %s", tt.zone, tt.n, mq.Name, mq.Type, tt.want, qminType)
+		}
+	}
+
+	qmin = qminOff
+	defer func() { qmin = qminRelaxed }()
+	if mq, minimised := minimise(q, rootName, 1); minimised || mq != q {
+		t.Errorf("minimised question %s with minimisation off", mq.Name)
+	}
+}
+
+func TestIsReferral(t *testing.T) {
+	ns := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")},
+	}
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("a.gtld-servers.net.")},
+	}
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		want bool
+	}{
+		{"referral", dnsmessage.Message{Authorities: []dnsmessage.Resource{ns}}, true},
+		{"nodata", dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true}, Authorities: []dnsmessage.Resource{soa}}, false},
+		{"nxdomain", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}, Authorities: []dnsmessage.Resource{soa}}, false},
+		{"authoritative ns", dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true}, Authorities: []dnsmessage.Resource{ns}}, false},
+	}
+	for _, tt := range tests {
+		if got := isReferral(tt.msg); got != tt.want {
+			t.Errorf("%s: got referral %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,75 @@
+/*
+Recursor is a recursive DNS resolver. It answers queries by asking the
+root nameservers, then the nameservers they refer it to, caching what
+it learns along the way.
+
+Settings are given as flags, or read from a file with -config:
+
+	recursor -config /etc/recursor.conf -log query
+
+The file holds one setting per line, named after the flag which sets it:
+
+	listen 127.0.0.1:53
+	listentls :853
+	listenhttps :443
+	cert /etc/recursor/cert.pem
+	key /etc/recursor/key.pem
+	allow 203.0.113.0/24
+	refuse 192.168.9.0/24
+	maxttl 6h
+	forward corp.example 192.0.2.1 192.0.2.2
+
+Queries are answered over UDP and TCP on each listen address, using DNS
+over TLS on each listentls address, and using DNS over HTTPS at
+/dns-query (see dohpath) on each listenhttps address.
+
+Only clients on the loopback and private networks are answered, unless
+further networks are given to allow. Queries from clients in networks
+given to deny are dropped without reply; those given to refuse are
+refused. Where networks overlap, the most specific applies.
+
+Queries may be answered by policy rather than resolved, to block
+malware or advertising domains. Policies are read from response policy
+zones (RPZ) in master file format, or from blocklists of names, one per
+line or in the format of a hosts file:
+
+	rpz rpz.example /etc/recursor/rpz.example.zone
+	blocklist /etc/recursor/ads.hosts
+
+Policy files are read again when they change, or on SIGHUP.
+
+Names may be answered from local data instead of being resolved.
+Local zones decide how names without local data are answered: static
+zones answer that they do not exist, transparent zones resolve them,
+redirect zones answer with the data of the zone's apex, and refuse
+zones refuse the query:
+
+	localzone home.arpa static
+	localdata nas.home.arpa. A 192.168.1.10
+	localzone ads.example redirect
+	localdata ads.example. A 0.0.0.0
+
+Clients in different networks may be given different local data. The
+localzone and localdata lines following a view line apply only to
+clients in its networks, who are answered from the first view
+matching them before the local data for all clients. Names in a local
+zone of the view are never answered from the local data for all
+clients, so a transparent zone in a view resolves names which other
+clients are answered locally:
+
+	view office 192.168.1.0/24 2001:db8:1::/48
+	localzone corp.example transparent
+	localdata intranet.corp.example. A 192.168.1.20
+
+Run recursor -h for the full list of settings.
+*/
 package main
 
 import (
+	"flag"
 	"fmt"
 	"golang.org/x/net/dns/dnsmessage"
+	"net"
 	"os"
 
 	"olowe.co/dns"
@@ -42,7 +109,14 @@ func rejectHandler(w dns.ResponseWriter, qmsg *dnsmessage.Message) bool {
 	return false
 }
 
+// handler answers queries from clients outside of any view.
 func handler(w dns.ResponseWriter, qmsg *dnsmessage.Message) {
+	answerQuery(w, qmsg, nil)
+}
+
+// answerQuery answers qmsg from local data of the view v, if not nil,
+// or for all clients. Other queries are resolved, subject to policy.
+func answerQuery(w dns.ResponseWriter, qmsg *dnsmessage.Message, v *localView) {
 	if rejected := rejectHandler(w, qmsg); rejected {
 		return
 	}
@@ -55,14 +129,41 @@ func handler(w dns.ResponseWriter, qmsg *dnsmessage.Message) {
 	rmsg.RecursionDesired = true
 
 	q := qmsg.Questions[0]
-	resolved, err := resolveFromRoot(q)
+	if local, ok := localAnswer(q, v); ok {
+		rmsg.Header.RCode = local.Header.RCode
+		rmsg.Header.Authoritative = local.Header.Authoritative
+		rmsg.Answers = local.Answers
+		rmsg.Authorities = local.Authorities
+		logAnswer(w, q, rmsg.Header.RCode)
+		w.WriteMsg(rmsg)
+		return
+	}
+	p, final := queryPolicy(q.Name)
+	if final && p != nil && p.action != policyPassthru {
+		answerPolicy(w, rmsg, q, p)
+		return
+	}
+	resolved, err := resolveOrStale(q)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		// without an answer, only the QNAME trigger can match.
+		if p != nil && p.action != policyPassthru {
+			answerPolicy(w, rmsg, q, p)
+			return
+		}
+		logf(logError, "%v", err)
 		rmsg.Header.RCode = dnsmessage.RCodeServerFailure
+		logAnswer(w, q, rmsg.Header.RCode)
 		w.WriteMsg(rmsg)
 		return
 	}
+	if p == nil || !final {
+		if p = responsePolicy(q, resolved); p != nil && p.action != policyPassthru {
+			answerPolicy(w, rmsg, q, p)
+			return
+		}
+	}
 	rmsg.Header.RCode = resolved.Header.RCode
+	logAnswer(w, q, rmsg.Header.RCode)
 	rmsg.Answers = resolved.Answers
 	if len(rmsg.Answers) == 0 {
 		rmsg.Authorities = resolved.Authorities
@@ -72,6 +173,71 @@ func handler(w dns.ResponseWriter, qmsg *dnsmessage.Message) {
 	w.WriteMsg(rmsg)
 }
 
+// clientIP returns the address of the client which sent the request
+// being answered by w, or nil if it is unknown.
+func clientIP(w dns.ResponseWriter) net.IP {
+	ra, ok := w.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return nil
+	}
+	switch a := ra.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func logAnswer(w dns.ResponseWriter, q dnsmessage.Question, rcode dnsmessage.RCode) {
+	logf(logQuery, "%s %s %s %s", clientIP(w), q.Name, q.Type, rcode)
+}
+
 func main() {
-	fmt.Fprintln(os.Stderr, dns.ListenAndServe("udp", "", handler))
+	defineFlags(flag.CommandLine)
+	conf := flag.String("config", "", "read settings from `file`; flags given on the command line take precedence")
+	flag.Parse()
+	if *conf != "" {
+		if err := applyConfig(*conf, flag.CommandLine, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "read config:", err)
+			os.Exit(2)
+		}
+	}
+	if err := validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if rootHints != "" {
+		var err error
+		if roots, err = readHintsFile(rootHints); err != nil {
+			fmt.Fprintln(os.Stderr, "read root hints:", err)
+			os.Exit(1)
+		}
+	}
+	// there is no need for root nameservers if we forward everything.
+	if _, ok := findForward(rootName); !ok {
+		if err := prime(); err != nil {
+			logf(logError, "%v", err)
+		}
+	}
+	if err := loadPolicies(); err != nil {
+		fmt.Fprintln(os.Stderr, "load policy:", err)
+		os.Exit(1)
+	}
+	if len(policyZones.list) > 0 {
+		go watchPolicies(policyReload)
+	}
+	if prefetchHits > 0 {
+		answers.Prefetch = refresh
+		answers.PrefetchHits = prefetchHits
+	}
+	go evictEvery(evictInterval)
+
+	errc, err := serveAll()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, <-errc)
+	os.Exit(1)
 }
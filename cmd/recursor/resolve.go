@@ -4,112 +4,164 @@ import (
 	"fmt"
 	"golang.org/x/net/dns/dnsmessage"
 	"net"
-	"os"
 	"strings"
 
 	"olowe.co/dns"
+	"olowe.co/dns/cache"
 )
 
-const rootA = "198.41.0.4"
-const rootB = "199.9.14.201"
-const rootC = "192.33.4.12"
-const rootD = "199.7.91.13"
-const rootE = "192.203.230.10"
-
-var roots []net.IP = []net.IP{net.ParseIP(rootA), net.ParseIP(rootB), net.ParseIP(rootC)}
-
 // appends the DNS port to the IP to be used in a dial string.
 func ip2dial(ip net.IP) string {
 	return net.JoinHostPort(ip.String(), "domain")
 }
 
-func isIPv6(ip net.IP) bool {
-	return strings.Contains(ip.String(), ":")
-}
-
+// filterRRs returns the records in rrs of type t named n, ignoring case.
 func filterRRs(rrs []dnsmessage.Resource, n dnsmessage.Name, t dnsmessage.Type) []dnsmessage.Resource {
 	var matches []dnsmessage.Resource
 	for _, r := range rrs {
-		if r.Header.Name == n && r.Header.Type == t {
+		if r.Header.Type == t && strings.EqualFold(r.Header.Name.String(), n.String()) {
 			matches = append(matches, r)
 		}
 	}
 	return matches
 }
 
-func resolveFromRoot(q dnsmessage.Question) (dnsmessage.Message, error) {
-	return resolve(q, roots, 0)
+// resolveFromRoot resolves q starting from the root nameservers,
+// following any CNAME and DNAME records. Queries sent to nameservers
+// are charged to b. Concurrent resolutions of the same question are
+// combined.
+func resolveFromRoot(q dnsmessage.Question, b *budget) (dnsmessage.Message, error) {
+	return dedup(q, &b.held, func(q dnsmessage.Question) (dnsmessage.Message, error) {
+		return resolveChain(q, b)
+	})
 }
 
-func resolve(q dnsmessage.Question, next []net.IP, depth int) (dnsmessage.Message, error) {
-	var rmsg dnsmessage.Message
-	var err error
-	if rrs, ok := lookup(q.Name, q.Type); ok {
-		fmt.Fprintln(os.Stderr, "cache served", q.Name, q.Type)
-		return dnsmessage.Message{Answers: rrs}, nil
+// resolve answers q from the cache if possible, otherwise asks the
+// nameservers at next. Glue and referrals in the cache are not used
+// as answers (RFC 2181 section 5.4.1).
+func resolve(q dnsmessage.Question, next []net.IP, depth int, b *budget) (dnsmessage.Message, error) {
+	if m, ok := answers.GetCredible(q, cache.CredAnswer); ok {
+		logf(logDebug, "cache served %s %s", q.Name, q.Type)
+		return m, nil
 	}
-	fmt.Fprintln(os.Stderr, "cache miss", q.Name, q.Type)
+	logf(logDebug, "cache miss %s %s", q.Name, q.Type)
+	return resolveUncached(q, next, depth, b)
+}
 
+// refresh resolves q from the root regardless of any cached answer,
+// updating the cache.
+func refresh(q dnsmessage.Question) {
+	if _, err := resolveUncached(q, roots, 0, newBudget()); err != nil {
+		logf(logError, "refresh: %v", err)
+	}
+}
+
+// resolveUncached resolves q without consulting the cache, starting
+// from the nameservers at next unless q is in a forward or stub zone.
+func resolveUncached(q dnsmessage.Question, next []net.IP, depth int, b *budget) (dnsmessage.Message, error) {
+	if fz, ok := findForward(q.Name); ok {
+		if len(fz.stub) > 0 {
+			return resolveZone(q, fz.name, fz.stub, depth, b)
+		}
+		return forward(q, fz, b)
+	}
+	return resolveZone(q, rootName, next, depth, b)
+}
+
+// resolveZone resolves q by asking next, the nameservers of zone.
+// Unless QNAME minimisation is off, the nameservers are first asked
+// about ancestors of the query name one label at a time, until we are
+// referred to a child zone or the full name is reached (RFC 9156).
+func resolveZone(q dnsmessage.Question, zone dnsmessage.Name, next []net.IP, depth int, b *budget) (dnsmessage.Message, error) {
 	if depth > 12 {
 		return dnsmessage.Message{}, fmt.Errorf("query loop")
 	}
 
-	for _, ip := range next {
-		// Aussie Broadband doesn't support IPv6 yet!
-		if isIPv6(ip) {
+	for n := 1; ; n++ {
+		mq, minimised := minimise(q, zone, n)
+		if !minimised {
+			break
+		}
+		rmsg, err := query(mq, next, b)
+		if err == nil && isReferral(rmsg) {
+			return followReferral(q, zone, rmsg, depth, b)
+		} else if err == nil && rmsg.Header.RCode == dnsmessage.RCodeSuccess {
+			// no zone cut here; the name may be an empty non-terminal.
 			continue
+		} else if err == nil && rmsg.Header.RCode == dnsmessage.RCodeNameError && qmin == qminStrict {
+			// nothing exists below a name which does not exist (RFC 8020).
+			insertNegative(q.Name, q.Type, rmsg)
+			return rmsg, nil
 		}
-		fmt.Fprintf(os.Stderr, "asking %s for %s %s\n", ip, q.Name, q.Type)
-		rmsg, err = dns.Ask(q, ip2dial(ip))
-		if rmsg.Header.Authoritative {
-			fmt.Println("got auth answer")
-			insert(q.Name, q.Type, rmsg.Answers)
-			fmt.Fprintln(os.Stderr, "cached", q.Name, q.Type)
-			return rmsg, err
-		} else if rmsg.Header.RCode == dnsmessage.RCodeSuccess && err == nil {
-			break
+		if qmin == qminStrict {
+			if err == nil {
+				err = fmt.Errorf("rcode %s", rmsg.Header.RCode)
+			}
+			return dnsmessage.Message{}, fmt.Errorf("resolve %s: minimised query for %s: %w", q.Name, mq.Name, err)
 		}
+		// Some servers wrongly answer NXDOMAIN for empty non-terminals,
+		// or fail minimised queries altogether. Fall back to asking
+		// for the full name.
+		logf(logDebug, "minimised query failed for %s %s", mq.Name, mq.Type)
+		break
+	}
+
+	rmsg, err := query(q, next, b)
+	if rmsg.Header.Authoritative {
+		logf(logDebug, "got auth answer for %s %s", q.Name, q.Type)
+		rmsg = sanitise(rmsg, zone)
+		cacheAnswer(q, rmsg, cache.CredAuthAnswer)
+		logf(logDebug, "cached %s %s", q.Name, q.Type)
+		return rmsg, err
 	}
 	if err != nil {
 		return dnsmessage.Message{}, fmt.Errorf("resolve %s: %w", q.Name, err)
 	}
-	fmt.Println("no auth answer")
+	logf(logDebug, "no auth answer for %s %s", q.Name, q.Type)
+	return followReferral(q, zone, rmsg, depth, b)
+}
 
-	// cache resource records from authorities, additionals sections if we
-	// don't have them already (i.e. from authoritative answers)
-	if len(rmsg.Authorities) > 0 {
-		if _, ok := lookup(rmsg.Authorities[0].Header.Name, rmsg.Authorities[0].Header.Type); !ok {
-			insert(rmsg.Authorities[0].Header.Name, rmsg.Authorities[0].Header.Type, rmsg.Authorities)
-			fmt.Fprintln(os.Stderr, "cached", q.Name, q.Type)
+// query asks the nameservers at next about q in turn, returning the
+// first authoritative answer or successful response. Each query sent
+// is charged to b, and none waits past its deadline.
+func query(q dnsmessage.Question, next []net.IP, b *budget) (dnsmessage.Message, error) {
+	var rmsg dnsmessage.Message
+	err := fmt.Errorf("no usable nameservers")
+	for _, ip := range orderServers(next) {
+		if !usable(ip) {
+			continue
 		}
-	}
-	for _, a := range rmsg.Additionals {
-		if _, ok := lookup(a.Header.Name, a.Header.Type); !ok {
-			matches := filterRRs(rmsg.Additionals, a.Header.Name, a.Header.Type)
-			insert(a.Header.Name, a.Header.Type, matches)
-			fmt.Fprintln(os.Stderr, "cached", q.Name, q.Type)
+		if err := b.charge(); err != nil {
+			return dnsmessage.Message{}, fmt.Errorf("resolve %s: %w", q.Name, err)
+		}
+		logf(logDebug, "asking %s for %s %s", ip, q.Name, q.Type)
+		rmsg, err = ask(q, ip, b.deadline)
+		if err == nil && (rmsg.Header.Authoritative || rmsg.Header.RCode == dnsmessage.RCodeSuccess) {
+			return rmsg, nil
 		}
 	}
+	return rmsg, err
+}
 
-	// get the IP addresses of the nameservers we were told about, then
-	// ask the same question to them
-	if len(rmsg.Authorities) > 0 {
-		for _, a := range rmsg.Authorities {
-			switch b := a.Body.(type) {
-			case *dnsmessage.NSResource:
-				newq := dnsmessage.Question{Name: b.NS, Type: dnsmessage.TypeA, Class: q.Class}
-				rmsg, err = resolveFromRoot(newq)
-				if err != nil {
-					continue
-				}
-				if len(rmsg.Answers) > 0 {
-					return resolve(q, dns.ExtractIPs(rmsg.Answers), depth+1)
-				}
-				return resolve(q, dns.ExtractIPs(rmsg.Additionals), depth+1)
-			default:
-				return rmsg, fmt.Errorf("unexpected authority resource type %s", a.Header.Type)
-			}
-		}
+// followReferral follows the referral in rmsg from the nameservers of
+// zone, asking the same question to the nameservers of the child zone.
+func followReferral(q dnsmessage.Question, zone dnsmessage.Name, rmsg dnsmessage.Message, depth int, b *budget) (dnsmessage.Message, error) {
+	ns := delegation(rmsg.Authorities, q.Name, zone)
+	if len(ns) == 0 {
+		return rmsg, fmt.Errorf("resolve %s: no usable referral from nameservers of %s", q.Name, zone)
+	}
+	cacheReferral(ns, rmsg.Additionals, zone)
+	child := ns[0].Header.Name
+	var ips []net.IP
+	for _, r := range ns {
+		ips = append(ips, dns.ExtractIPs(glue(rmsg.Additionals, r.Body.(*dnsmessage.NSResource).NS, zone))...)
+	}
+	if len(ips) == 0 {
+		// get the IP addresses of the nameservers we were told about
+		ips = nsAddrs(ns, q.Class, b)
+	}
+	if len(ips) > 0 {
+		return resolveZone(q, child, ips, depth+1, b)
 	}
 
 	// return our best guess anyway
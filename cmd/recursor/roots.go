@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+	"olowe.co/dns/cache"
+)
+
+// defaultHints is the root hints file published by IANA at
+// https://www.internic.net/domain/named.root
+//
+//go:embed named.root
+var defaultHints string
+
+var rootName = dnsmessage.MustNewName(".")
+
+// roots holds the addresses of the root nameservers. It is set from
+// the root hints, then replaced once the roots have been primed.
+var roots []net.IP = mustHints(strings.NewReader(defaultHints))
+
+// network is "ip4" or "ip6" to only contact nameservers over IPv4 or
+// IPv6 respectively, or "ip" for both.
+var network = "ip"
+
+func mustHints(r io.Reader) []net.IP {
+	ips, err := readHints(r)
+	if err != nil {
+		panic(err)
+	}
+	return ips
+}
+
+// readHints reads the addresses of the root nameservers from a root
+// hints file such as named.root. Only the subset of the master file
+// format used by such files is understood: one record per line, each
+// an owner name, optional TTL and class, and an NS, A or AAAA record's
+// type and data. Comments start with a semicolon.
+func readHints(r io.Reader) ([]net.IP, error) {
+	var rrs []dnsmessage.Resource
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rr, err := parseHint(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	ips := rootAddrs(rrs, rrs)
+	if len(ips) == 0 {
+		return nil, errors.New("no root nameserver addresses")
+	}
+	return ips, nil
+}
+
+func parseHint(fields []string) (dnsmessage.Resource, error) {
+	if len(fields) < 3 || len(fields) > 5 {
+		return dnsmessage.Resource{}, fmt.Errorf("want owner, type and data; got %d fields", len(fields))
+	}
+	name, err := dnsmessage.NewName(absName(fields[0]))
+	if err != nil {
+		return dnsmessage.Resource{}, fmt.Errorf("owner %s: %w", fields[0], err)
+	}
+	rr := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET}}
+	typ, data := strings.ToUpper(fields[len(fields)-2]), fields[len(fields)-1]
+	switch typ {
+	case "NS":
+		ns, err := dnsmessage.NewName(absName(data))
+		if err != nil {
+			return rr, fmt.Errorf("nameserver %s: %w", data, err)
+		}
+		rr.Header.Type = dnsmessage.TypeNS
+		rr.Body = &dnsmessage.NSResource{NS: ns}
+	case "A":
+		ip := net.ParseIP(data).To4()
+		if ip == nil {
+			return rr, fmt.Errorf("bad IPv4 address %s", data)
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		rr.Header.Type = dnsmessage.TypeA
+		rr.Body = &a
+	case "AAAA":
+		ip := net.ParseIP(data)
+		if ip == nil || ip.To4() != nil {
+			return rr, fmt.Errorf("bad IPv6 address %s", data)
+		}
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], ip)
+		rr.Header.Type = dnsmessage.TypeAAAA
+		rr.Body = &aaaa
+	default:
+		return rr, fmt.Errorf("unsupported record type %s", fields[len(fields)-2])
+	}
+	return rr, nil
+}
+
+// absName returns name made absolute, relative to the root.
+func absName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func readHintsFile(name string) ([]net.IP, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHints(f)
+}
+
+// rootAddrs returns the addresses in glue of the nameservers of the
+// root zone listed in ns.
+func rootAddrs(ns, glue []dnsmessage.Resource) []net.IP {
+	names := make(map[string]bool)
+	for _, r := range ns {
+		if b, ok := r.Body.(*dnsmessage.NSResource); ok && r.Header.Name == rootName {
+			names[strings.ToLower(b.NS.String())] = true
+		}
+	}
+	var ips []net.IP
+	for _, r := range glue {
+		if names[strings.ToLower(r.Header.Name.String())] {
+			ips = append(ips, dns.ExtractIPs([]dnsmessage.Resource{r})...)
+		}
+	}
+	return ips
+}
+
+// primeTimeout is the longest spent priming the root nameservers, so
+// that an unreachable network doesn't hold up starting to serve.
+const primeTimeout = 3 * time.Second
+
+// prime asks the root nameservers for the current list of root
+// nameservers (RFC 8109), replacing the addresses from the hints.
+// It gives up after primeTimeout, leaving the hints in use.
+func prime() error {
+	q := dnsmessage.Question{Name: rootName, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+	deadline := time.Now().Add(primeTimeout)
+	var err error
+	for _, ip := range orderServers(roots) {
+		if !usable(ip) {
+			continue
+		}
+		var rmsg dnsmessage.Message
+		rmsg, err = ask(q, ip, deadline)
+		if err != nil {
+			continue
+		}
+		ips := rootAddrs(rmsg.Answers, rmsg.Additionals)
+		if len(ips) == 0 {
+			err = fmt.Errorf("no root nameserver addresses from %s", ip)
+			continue
+		}
+		insert(q.Name, q.Type, filterRRs(rmsg.Answers, rootName, dnsmessage.TypeNS), cache.CredAuthAnswer)
+		roots = ips
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no root nameservers reachable over %s", network)
+	}
+	return fmt.Errorf("prime root nameservers: %w", err)
+}
+
+// usable reports whether we may contact the nameserver at ip
+// given the network in use.
+func usable(ip net.IP) bool {
+	switch network {
+	case "ip4":
+		return ip.To4() != nil
+	case "ip6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// addrTypes returns the types of address records to look up for
+// nameservers without glue.
+func addrTypes() []dnsmessage.Type {
+	switch network {
+	case "ip4":
+		return []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		return []dnsmessage.Type{dnsmessage.TypeAAAA}
+	}
+	return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+}
+
+// udpNetwork returns the network with which to contact ip over UDP.
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
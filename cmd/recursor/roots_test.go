@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadHints(t *testing.T) {
+	ips, err := readHints(strings.NewReader(defaultHints))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v4, v6 int
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	if v4 != 13 || v6 != 13 {
+		t.Errorf("got %d IPv4 and %d IPv6 root addresses, want 13 of each", v4, v6)
+	}
+
+	// addresses of servers which aren't root nameservers are ignored.
+	hints := `.	3600000	NS	a.root-servers.test.
+a.root-servers.test.	3600000	A	192.0.2.1
+other.test.	3600000	A	192.0.2.2
+`
+	ips, err = readHints(strings.NewReader(hints))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got root addresses %v, want [192.0.2.1]", ips)
+	}
+	if _, err := readHints(strings.NewReader(". 3600 NS a.root-servers.test.\n")); err == nil {
+		t.Error("nil error reading hints without addresses")
+	}
+	for _, bad := range []string{
+		"a.root-servers.test. 3600 A 192.0.2",
+		"a.root-servers.test. 3600 AAAA 192.0.2.1",
+		"a.root-servers.test. 3600 MX 10 mail.test.",
+		"a.root-servers.test.",
+	} {
+		if _, err := readHints(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: nil error", bad)
+		}
+	}
+}
+
+func TestUsable(t *testing.T) {
+	defer func(n string) { network = n }(network)
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		network string
+		v4, v6  bool
+	}{
+		{"ip", true, true},
+		{"ip4", true, false},
+		{"ip6", false, true},
+	}
+	for _, tt := range tests {
+		network = tt.network
+		if usable(v4) != tt.v4 || usable(v6) != tt.v6 {
+			t.Errorf("%s: IPv4 usable %t, IPv6 usable %t; want %t, %t", tt.network, usable(v4), usable(v6), tt.v4, tt.v6)
+		}
+	}
+}
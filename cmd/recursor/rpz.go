@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+// Policy actions, selected in a response policy zone by the target
+// of a CNAME record at the trigger. Any other records at a trigger
+// are local data.
+const (
+	policyNXDomain  = iota // CNAME .
+	policyNoData           // CNAME *.
+	policyPassthru         // CNAME rpz-passthru.
+	policyDrop             // CNAME rpz-drop.
+	policyLocalData        // answer with the records at the trigger
+)
+
+var policyActions = []string{"nxdomain", "nodata", "passthru", "drop", "local-data"}
+
+// A policy is what to do with queries matching a trigger.
+type policy struct {
+	action int
+	// data holds the records of a local-data policy.
+	data []dnsmessage.Resource
+	zone *policyZone
+}
+
+type ipTrigger struct {
+	net *net.IPNet
+	p   *policy
+}
+
+// A policyZone holds the triggers read from a response policy zone
+// (RPZ) or blocklist file. Once read, it is not modified; the zone is
+// replaced whole when the file is read again.
+type policyZone struct {
+	// name is the name of the RPZ, or the file name of a blocklist.
+	name      string
+	file      string
+	blocklist bool
+	modTime   time.Time
+	// soa, if set, is the authority of NXDOMAIN and NODATA answers.
+	soa *dnsmessage.Resource
+
+	// qname and nsdname map lower-case names to their policies.
+	// Keys starting with "*." are wildcards matching any subdomain.
+	qname   map[string]*policy
+	nsdname map[string]*policy
+	ips     []ipTrigger
+}
+
+// policyZones holds the configured policy zones. Earlier zones take
+// precedence over later ones.
+var policyZones = struct {
+	list []*policyZone
+	sync.RWMutex
+}{}
+
+// policyReload is how often policy files are checked for changes.
+var policyReload = time.Minute
+
+// addPolicyZone adds the RPZ named name, or the blocklist if
+// blocklist is set, to be read from file.
+func addPolicyZone(name, file string, blocklist bool) error {
+	if blocklist {
+		name = file
+	} else {
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		if _, err := dnsmessage.NewName(name); err != nil {
+			return fmt.Errorf("policy zone %s: %w", name, err)
+		}
+	}
+	policyZones.Lock()
+	defer policyZones.Unlock()
+	for _, pz := range policyZones.list {
+		if pz.file == file {
+			return fmt.Errorf("policy file %s already configured", file)
+		}
+	}
+	policyZones.list = append(policyZones.list, &policyZone{name: name, file: file, blocklist: blocklist})
+	return nil
+}
+
+// loadPolicies reads every policy zone, returning the first error.
+func loadPolicies() error {
+	policyZones.Lock()
+	defer policyZones.Unlock()
+	for i, pz := range policyZones.list {
+		npz, err := pz.read()
+		if err != nil {
+			return err
+		}
+		policyZones.list[i] = npz
+	}
+	return nil
+}
+
+// reloadPolicies reads again the policy zones whose files have been
+// modified since they were last read, or all of them if force is set.
+// Zones which cannot be read keep the triggers they had.
+func reloadPolicies(force bool) {
+	policyZones.RLock()
+	list := make([]*policyZone, len(policyZones.list))
+	copy(list, policyZones.list)
+	policyZones.RUnlock()
+
+	for i, pz := range list {
+		if !force {
+			fi, err := os.Stat(pz.file)
+			if err == nil && fi.ModTime().Equal(pz.modTime) {
+				continue
+			}
+		}
+		npz, err := pz.read()
+		if err != nil {
+			logf(logError, "reload policy: %v", err)
+			continue
+		}
+		logf(logDebug, "reloaded policy zone %s", pz.name)
+		policyZones.Lock()
+		if i < len(policyZones.list) && policyZones.list[i] == pz {
+			policyZones.list[i] = npz
+		}
+		policyZones.Unlock()
+	}
+}
+
+// watchPolicies reloads changed policy zones every interval, and all
+// of them when the process receives SIGHUP.
+func watchPolicies(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+	for {
+		select {
+		case <-hup:
+			reloadPolicies(true)
+		case <-tick:
+			reloadPolicies(false)
+		}
+	}
+}
+
+// read returns a new policy zone with the triggers in the file of pz.
+func (pz *policyZone) read() (*policyZone, error) {
+	f, err := os.Open(pz.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	npz := &policyZone{
+		name:      pz.name,
+		file:      pz.file,
+		blocklist: pz.blocklist,
+		modTime:   fi.ModTime(),
+		qname:     make(map[string]*policy),
+		nsdname:   make(map[string]*policy),
+	}
+	if pz.blocklist {
+		err = npz.readBlocklist(f)
+	} else {
+		err = npz.readRPZ(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", pz.file, err)
+	}
+	return npz, nil
+}
+
+// readRPZ reads triggers from the master file of a response policy
+// zone. Triggers are the owner names of records, relative to the zone:
+//
+//	ads.example        CNAME .              ; QNAME trigger
+//	*.ads.example      CNAME .              ; QNAME trigger for subdomains
+//	24.0.2.0.192.rpz-ip CNAME *.            ; response IP trigger for 192.0.2.0/24
+//	ns.bad.example.rpz-nsdname CNAME .      ; NSDNAME trigger
+//
+// Response IP triggers are written as the prefix length followed by the
+// labels of the address in reverse, with zz standing in for :: in IPv6
+// addresses. NSIP and client IP triggers are ignored.
+func (pz *policyZone) readRPZ(r io.Reader) error {
+	origin := dnsmessage.MustNewName(pz.name)
+	z, err := readZone(r, origin)
+	if err != nil {
+		return err
+	}
+	pz.soa = &dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: origin, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: z.SOA.MinTTL},
+		Body:   &z.SOA,
+	}
+
+	// group records by owner, keeping their order.
+	suffix := "." + strings.ToLower(pz.name)
+	var owners []string
+	rrs := make(map[string][]dnsmessage.Resource)
+	for _, rr := range z.Resources {
+		owner := strings.ToLower(rr.Header.Name.String())
+		if !strings.HasSuffix(owner, suffix) {
+			continue // the apex, or outside the zone
+		}
+		rel := strings.TrimSuffix(owner, suffix)
+		if _, ok := rrs[rel]; !ok {
+			owners = append(owners, rel)
+		}
+		rrs[rel] = append(rrs[rel], rr)
+	}
+
+	for _, rel := range owners {
+		p := pz.policy(rrs[rel])
+		switch {
+		case strings.HasSuffix(rel, ".rpz-ip"):
+			n, err := parseIPTrigger(strings.TrimSuffix(rel, ".rpz-ip"))
+			if err != nil {
+				return fmt.Errorf("trigger %s: %w", rel, err)
+			}
+			pz.ips = append(pz.ips, ipTrigger{n, p})
+		case strings.HasSuffix(rel, ".rpz-nsdname"):
+			pz.nsdname[strings.TrimSuffix(rel, "rpz-nsdname")] = p
+		case strings.HasSuffix(rel, ".rpz-nsip"), strings.HasSuffix(rel, ".rpz-client-ip"):
+			logf(logDebug, "policy zone %s: ignoring unsupported trigger %s", pz.name, rel)
+		default:
+			pz.qname[rel+"."] = p
+		}
+	}
+	return nil
+}
+
+// policy returns the policy selected by the records at a trigger.
+func (pz *policyZone) policy(rrs []dnsmessage.Resource) *policy {
+	for _, rr := range rrs {
+		c, ok := rr.Body.(*dnsmessage.CNAMEResource)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(c.CNAME.String()) {
+		case ".":
+			return &policy{action: policyNXDomain, zone: pz}
+		case "*.":
+			return &policy{action: policyNoData, zone: pz}
+		case "rpz-passthru.":
+			return &policy{action: policyPassthru, zone: pz}
+		case "rpz-drop.":
+			return &policy{action: policyDrop, zone: pz}
+		}
+	}
+	return &policy{action: policyLocalData, data: rrs, zone: pz}
+}
+
+// parseIPTrigger parses the network of a response IP trigger, such as
+// 24.0.2.0.192 for 192.0.2.0/24 or 48.zz.db8.2001 for 2001:db8::/48.
+func parseIPTrigger(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("missing address")
+	}
+	ones, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad prefix length %q", labels[0])
+	}
+	addr := labels[1:]
+	for i, j := 0, len(addr)-1; i < j; i, j = i+1, j-1 {
+		addr[i], addr[j] = addr[j], addr[i]
+	}
+	var ip net.IP
+	if len(addr) == 4 {
+		ip = net.ParseIP(strings.Join(addr, ".")).To4()
+	}
+	if ip == nil {
+		for i := range addr {
+			if addr[i] == "zz" {
+				addr[i] = ""
+			}
+		}
+		s := strings.Join(addr, ":")
+		if strings.HasPrefix(s, ":") {
+			s = ":" + s
+		}
+		if strings.HasSuffix(s, ":") {
+			s += ":"
+		}
+		ip = net.ParseIP(s)
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("bad address")
+	}
+	bits := 8 * len(ip)
+	if ones < 1 || ones > bits {
+		return nil, fmt.Errorf("bad prefix length %d", ones)
+	}
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// readBlocklist reads a list of names to answer with NXDOMAIN. Each
+// line is either in the format of a hosts file, an address followed by
+// names which are blocked, or a single name which is blocked along
+// with all its subdomains. Text after # is a comment.
+func (pz *policyZone) readBlocklist(r io.Reader) error {
+	blocked := &policy{action: policyNXDomain, zone: pz}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		var names []string
+		var subdomains bool
+		switch {
+		case len(fields) == 0:
+			continue
+		case net.ParseIP(fields[0]) != nil:
+			names = fields[1:]
+		case len(fields) == 1:
+			names, subdomains = fields, true
+		default:
+			return fmt.Errorf("line %d: want a name, or an address followed by names", n)
+		}
+		for _, s := range names {
+			if localHosts[strings.ToLower(s)] || net.ParseIP(s) != nil {
+				continue
+			}
+			if !strings.HasSuffix(s, ".") {
+				s += "."
+			}
+			if _, err := dnsmessage.NewName(s); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			k := strings.ToLower(s)
+			pz.qname[k] = blocked
+			if subdomains {
+				pz.qname["*."+k] = blocked
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// localHosts are names found in hosts files which must not be blocked.
+var localHosts = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// matchName returns the policy of the trigger in triggers matching
+// name exactly or, failing that, of the closest matching wildcard.
+func matchName(triggers map[string]*policy, name string) *policy {
+	name = strings.ToLower(name)
+	if p, ok := triggers[name]; ok {
+		return p
+	}
+	for i := strings.Index(name, "."); i >= 0 && i < len(name)-1; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		if p, ok := triggers["*."+name]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// matchIPs returns the policy of the most specific response IP trigger
+// of pz containing any of ips.
+func (pz *policyZone) matchIPs(ips []net.IP) *policy {
+	var best *policy
+	bestOnes := -1
+	for _, t := range pz.ips {
+		ones, _ := t.net.Mask.Size()
+		if ones <= bestOnes {
+			continue
+		}
+		for _, ip := range ips {
+			if t.net.Contains(ip) {
+				best, bestOnes = t.p, ones
+				break
+			}
+		}
+	}
+	return best
+}
+
+// queryPolicy returns the policy of the first QNAME trigger matching
+// name, checked before the name is resolved, or nil if there is none.
+// Policy zones are checked in order, so the policy is final only if no
+// zone before the one holding it has response IP or NSDNAME triggers,
+// which can only be checked once name is resolved. Otherwise
+// responsePolicy decides on the resolved answer.
+func queryPolicy(name dnsmessage.Name) (p *policy, final bool) {
+	policyZones.RLock()
+	defer policyZones.RUnlock()
+	final = true
+	for _, pz := range policyZones.list {
+		if p := matchName(pz.qname, name.String()); p != nil {
+			return p, final
+		}
+		if len(pz.ips) > 0 || len(pz.nsdname) > 0 {
+			final = false
+		}
+	}
+	return nil, true
+}
+
+// responsePolicy returns the policy applying to rmsg, the resolved
+// answer to q, or nil if there is none. The first policy zone with a
+// trigger matching takes precedence. In each zone, QNAME triggers for
+// the name in q and the targets of aliases in the answer are checked
+// first, then response IP triggers for its addresses, then NSDNAME
+// triggers for the cached nameservers of the zone holding the answer.
+func responsePolicy(q dnsmessage.Question, rmsg dnsmessage.Message) *policy {
+	links, target, _, err := follow(q, rmsg.Answers)
+	if err != nil {
+		target = q.Name
+	}
+	ips := dns.ExtractIPs(rmsg.Answers)
+	ns := zoneNS(target)
+
+	policyZones.RLock()
+	defer policyZones.RUnlock()
+	for _, pz := range policyZones.list {
+		if p := matchName(pz.qname, q.Name.String()); p != nil {
+			return p
+		}
+		for _, l := range links {
+			if p := matchName(pz.qname, l.target.String()); p != nil {
+				return p
+			}
+		}
+		if p := pz.matchIPs(ips); p != nil {
+			return p
+		}
+		for _, name := range ns {
+			if p := matchName(pz.nsdname, name); p != nil {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// zoneNS returns the names of the nameservers, as known to the cache,
+// of the closest zone enclosing name other than the root.
+func zoneNS(name dnsmessage.Name) []string {
+	for i := countLabels(name); i > 0; i-- {
+		rrs, ok := lookup(ancestor(name, i), dnsmessage.TypeNS)
+		if !ok {
+			continue
+		}
+		var names []string
+		for _, rr := range rrs {
+			if ns, ok := rr.Body.(*dnsmessage.NSResource); ok {
+				names = append(names, ns.NS.String())
+			}
+		}
+		if len(names) > 0 {
+			return names
+		}
+	}
+	return nil
+}
+
+// answerPolicy writes to w the answer to q directed by policy p, using
+// rmsg as the reply. A dropped query is not answered at all.
+func answerPolicy(w dns.ResponseWriter, rmsg dnsmessage.Message, q dnsmessage.Question, p *policy) {
+	logf(logQuery, "%s %s %s %s by policy zone %s", clientIP(w), q.Name, q.Type, policyActions[p.action], p.zone.name)
+	switch p.action {
+	case policyDrop:
+		return
+	case policyNXDomain:
+		rmsg.Header.RCode = dnsmessage.RCodeNameError
+	case policyLocalData:
+		rmsg.Answers = p.answer(q)
+	}
+	if len(rmsg.Answers) == 0 && p.zone.soa != nil {
+		rmsg.Authorities = []dnsmessage.Resource{*p.zone.soa}
+	}
+	w.WriteMsg(rmsg)
+}
+
+// answer returns the local data of p answering q, owned by the name
+// in q. If the data is a CNAME, its target is resolved as usual.
+func (p *policy) answer(q dnsmessage.Question) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	var target *dnsmessage.Name
+	for _, rr := range p.data {
+		if rr.Header.Type != q.Type && rr.Header.Type != dnsmessage.TypeCNAME {
+			continue
+		}
+		rr.Header.Name = q.Name
+		rrs = append(rrs, rr)
+		if c, ok := rr.Body.(*dnsmessage.CNAMEResource); ok && q.Type != dnsmessage.TypeCNAME {
+			target = &c.CNAME
+			rrs = rrs[len(rrs)-1:]
+			break
+		}
+	}
+	if target == nil {
+		return rrs
+	}
+	resolved, err := resolveOrStale(dnsmessage.Question{Name: *target, Type: q.Type, Class: q.Class})
+	if err != nil {
+		logf(logError, "resolve local data target: %v", err)
+		return rrs
+	}
+	return append(rrs, resolved.Answers...)
+}
+
+// rpzFlag is a flag.Value adding a response policy zone given in the
+// form zone=file.
+type rpzFlag struct{}
+
+func (rpzFlag) String() string { return "" }
+
+func (rpzFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("missing = between zone and file")
+	}
+	return addPolicyZone(s[:i], s[i+1:], false)
+}
+
+// blocklistFlag is a flag.Value adding a blocklist file.
+type blocklistFlag struct{}
+
+func (blocklistFlag) String() string { return "" }
+
+func (blocklistFlag) Set(s string) error {
+	return addPolicyZone("", s, true)
+}
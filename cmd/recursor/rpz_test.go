@@ -0,0 +1,305 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns/cache"
+)
+
+const testRPZ = `$ORIGIN rpz.example.
+$TTL 300
+@	SOA	ns.rpz.example. hostmaster.rpz.example. 1 3600 600 86400 60
+	NS	ns.rpz.example.
+ads.example	CNAME	.
+*.ads.example	CNAME	.
+ok.ads.example	CNAME	rpz-passthru.
+empty.example	CNAME	*.
+drop.example	CNAME	rpz-drop.
+walled.example	A	192.0.2.80
+	AAAA	2001:db8::80
+24.0.2.0.198.rpz-ip	CNAME	.
+32.1.2.0.198.rpz-ip	CNAME	rpz-passthru.
+48.zz.db8.2001.rpz-ip	CNAME	*.
+ns.bad.example.rpz-nsdname	CNAME	.
+`
+
+const testBlocklist = `# hosts file
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 tracker.example  Beacon.Example
+::1 ip6-localhost
+malware.example # and its subdomains
+`
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// savePolicies returns a function restoring the configured policy zones.
+func savePolicies() func() {
+	policyZones.RLock()
+	list := policyZones.list
+	policyZones.RUnlock()
+	return func() {
+		policyZones.Lock()
+		policyZones.list = list
+		policyZones.Unlock()
+	}
+}
+
+func TestReadRPZ(t *testing.T) {
+	pz := &policyZone{name: "rpz.example.", file: writeTemp(t, "rpz.zone", testRPZ)}
+	pz, err := pz.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]int{
+		"ads.example.":       policyNXDomain,
+		"www.ADS.example.":   policyNXDomain,
+		"ok.ads.example.":    policyPassthru,
+		"empty.example.":     policyNoData,
+		"drop.example.":      policyDrop,
+		"walled.example.":    policyLocalData,
+		"a.b.ads.example.":   policyNXDomain,
+		"notads.example.":    -1,
+		"www.empty.example.": -1,
+	}
+	for name, want := range names {
+		p := matchName(pz.qname, name)
+		if p == nil && want >= 0 {
+			t.Errorf("%s: no policy, want %s", name, policyActions[want])
+		} else if p != nil && p.action != want {
+			t.Errorf("%s: got policy %s, want %d", name, policyActions[p.action], want)
+		}
+	}
+	if p := matchName(pz.qname, "walled.example."); p == nil || len(p.data) != 2 {
+		t.Errorf("got local data policy %+v", p)
+	}
+
+	ips := map[string]int{
+		"198.0.2.1":     policyPassthru,
+		"198.0.2.200":   policyNXDomain,
+		"198.0.3.1":     -1,
+		"2001:db8::1":   policyNoData,
+		"2001:db8:1::1": -1,
+	}
+	for addr, want := range ips {
+		p := pz.matchIPs([]net.IP{net.ParseIP(addr)})
+		if p == nil && want >= 0 {
+			t.Errorf("%s: no policy, want %s", addr, policyActions[want])
+		} else if p != nil && p.action != want {
+			t.Errorf("%s: got policy %s, want %d", addr, policyActions[p.action], want)
+		}
+	}
+	if p := matchName(pz.nsdname, "NS.bad.example."); p == nil || p.action != policyNXDomain {
+		t.Errorf("got nsdname policy %+v", p)
+	}
+	if pz.soa == nil {
+		t.Error("no SOA for zone")
+	}
+}
+
+func TestParseIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"24.0.2.0.192":      "192.0.2.0/24",
+		"32.1.2.0.192":      "192.0.2.1/32",
+		"8.1.2.0.192":       "192.0.0.0/8",
+		"128.1.zz.db8.2001": "2001:db8::1/128",
+		"48.zz.db8.2001":    "2001:db8::/48",
+		"128.1.zz":          "::1/128",
+	}
+	for in, want := range tests {
+		n, err := parseIPTrigger(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if n.String() != want {
+			t.Errorf("%s: got %s, want %s", in, n, want)
+		}
+	}
+	for _, in := range []string{"24", "33.1.2.0.192", "x.1.2.0.192", "24.1.2.192", "0.1.2.0.192"} {
+		if _, err := parseIPTrigger(in); err == nil {
+			t.Errorf("%s: nil error", in)
+		}
+	}
+}
+
+func TestReadBlocklist(t *testing.T) {
+	pz := &policyZone{name: "list", file: writeTemp(t, "hosts", testBlocklist), blocklist: true}
+	pz, err := pz.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{
+		"tracker.example.":     true,
+		"beacon.example.":      true,
+		"www.tracker.example.": false,
+		"malware.example.":     true,
+		"cdn.malware.example.": true,
+		"localhost.":           false,
+		"ip6-localhost.":       false,
+	}
+	for name, want := range names {
+		if p := matchName(pz.qname, name); (p != nil) != want {
+			t.Errorf("%s: blocked %v, want %v", name, p != nil, want)
+		}
+	}
+
+	bad := &policyZone{name: "bad", file: writeTemp(t, "bad", "two names.example\n"), blocklist: true}
+	if _, err := bad.read(); err == nil {
+		t.Error("nil error reading bad blocklist")
+	}
+}
+
+// msgWriter records the messages written in reply to a query.
+type msgWriter struct {
+	msgs []dnsmessage.Message
+}
+
+func (w *msgWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *msgWriter) WriteMsg(msg dnsmessage.Message) error {
+	w.msgs = append(w.msgs, msg)
+	return nil
+}
+
+func TestQueryPolicy(t *testing.T) {
+	defer savePolicies()()
+	policyZones.list = nil
+	if err := addPolicyZone("rpz.example", writeTemp(t, "rpz.zone", testRPZ), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := addPolicyZone("", writeTemp(t, "hosts", testBlocklist), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPolicies(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, t dnsmessage.Type) *msgWriter {
+		w := &msgWriter{}
+		handler(w, &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET}},
+		})
+		return w
+	}
+	// tracker.example is blocked by a zone after one with response IP
+	// triggers, so is resolved before the blocklist applies.
+	tracker := dnsmessage.MustNewName("tracker.example.")
+	insert(tracker, dnsmessage.TypeA, []dnsmessage.Resource{testA(tracker.String(), 300)}, cache.CredAuthAnswer)
+	tests := []struct {
+		name    string
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		{"www.ads.example.", dnsmessage.RCodeNameError, 0},
+		{"empty.example.", dnsmessage.RCodeSuccess, 0},
+		{"walled.example.", dnsmessage.RCodeSuccess, 1},
+		{"tracker.example.", dnsmessage.RCodeNameError, 0},
+	}
+	for _, tt := range tests {
+		w := query(tt.name, dnsmessage.TypeA)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: got %d replies", tt.name, len(w.msgs))
+		}
+		rmsg := w.msgs[0]
+		if rmsg.Header.RCode != tt.rcode || len(rmsg.Answers) != tt.answers {
+			t.Errorf("%s: got %s with %d answers, want %s with %d", tt.name, rmsg.Header.RCode, len(rmsg.Answers), tt.rcode, tt.answers)
+		}
+		for _, rr := range rmsg.Answers {
+			if rr.Header.Name.String() != tt.name || rr.Header.Type != dnsmessage.TypeA {
+				t.Errorf("%s: unexpected answer %v", tt.name, rr)
+			}
+		}
+	}
+	if w := query("drop.example.", dnsmessage.TypeA); len(w.msgs) != 0 {
+		t.Errorf("dropped query answered: %v", w.msgs)
+	}
+}
+
+func TestPolicyOrder(t *testing.T) {
+	defer savePolicies()()
+	policyZones.list = nil
+	const ipRPZ = `$ORIGIN first.example.
+@	SOA	ns.first.example. hostmaster.first.example. 1 3600 600 86400 60
+32.1.2.0.192.rpz-ip	CNAME	*.
+`
+	if err := addPolicyZone("first.example", writeTemp(t, "first.zone", ipRPZ), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := addPolicyZone("", writeTemp(t, "hosts", "ordered.example\nunmatched.example\n"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPolicies(); err != nil {
+		t.Fatal(err)
+	}
+
+	ordered := dnsmessage.MustNewName("ordered.example.")
+	if p, final := queryPolicy(ordered); p == nil || final {
+		t.Fatalf("got query policy %v final %v, want a policy decided after resolving", p, final)
+	}
+	unmatched := testA("unmatched.example.", 300)
+	unmatched.Body = &dnsmessage.AResource{A: [4]byte{198, 51, 100, 1}}
+	insert(ordered, dnsmessage.TypeA, []dnsmessage.Resource{testA(ordered.String(), 300)}, cache.CredAuthAnswer)
+	insert(unmatched.Header.Name, dnsmessage.TypeA, []dnsmessage.Resource{unmatched}, cache.CredAuthAnswer)
+
+	// the IP trigger of the first zone applies before the QNAME
+	// trigger of the second; without a match, the second applies.
+	tests := map[string]dnsmessage.RCode{
+		"ordered.example.":   dnsmessage.RCodeSuccess,
+		"unmatched.example.": dnsmessage.RCodeNameError,
+	}
+	for name, rcode := range tests {
+		w := &msgWriter{}
+		handler(w, &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		})
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: got %d replies", name, len(w.msgs))
+		}
+		if rmsg := w.msgs[0]; rmsg.Header.RCode != rcode || len(rmsg.Answers) != 0 {
+			t.Errorf("%s: got %s with %d answers, want %s with none", name, rmsg.Header.RCode, len(rmsg.Answers), rcode)
+		}
+	}
+}
+
+func TestReloadPolicies(t *testing.T) {
+	defer savePolicies()()
+	policyZones.list = nil
+	file := writeTemp(t, "list", "old.example\n")
+	if err := addPolicyZone("", file, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("new.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadPolicies(true)
+	old, _ := queryPolicy(dnsmessage.MustNewName("old.example."))
+	p, _ := queryPolicy(dnsmessage.MustNewName("new.example."))
+	if old != nil || p == nil {
+		t.Error("policy not reloaded")
+	}
+	// a broken file keeps the policies last read.
+	if err := os.WriteFile(file, []byte("broken list\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadPolicies(true)
+	if p, _ := queryPolicy(dnsmessage.MustNewName("new.example.")); p == nil {
+		t.Error("policy lost on failed reload")
+	}
+}
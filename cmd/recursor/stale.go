@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// staleAnswerTimeout is how long to wait for resolution before
+// answering with stale data from the cache, if there is any.
+// RFC 8767 section 5 suggests 1.8 seconds.
+var staleAnswerTimeout = 1800 * time.Millisecond
+
+// resolveTimeout is the longest a client waits for an answer. If
+// resolution takes longer, the client is answered with stale data if
+// there is any, or an error.
+var resolveTimeout = 5 * time.Second
+
+var errDeadline = errors.New("resolution timed out")
+
+// resolveOrStale resolves q from the root, answering with expired data
+// from the cache (RFC 8767) if resolution fails or takes longer than
+// staleAnswerTimeout. In the latter case resolution continues in the
+// background, refreshing the cache with its answer.
+func resolveOrStale(q dnsmessage.Question) (dnsmessage.Message, error) {
+	b := newBudget()
+	return answerOrStale(q, func() (dnsmessage.Message, error) {
+		return resolveFromRoot(q, b)
+	})
+}
+
+// answerOrStale returns the answer to q from resolve, which is run in
+// the background, or stale data from the cache as described for
+// resolveOrStale. It waits at most resolveTimeout for resolve.
+func answerOrStale(q dnsmessage.Question, resolve func() (dnsmessage.Message, error)) (dnsmessage.Message, error) {
+	type result struct {
+		msg dnsmessage.Message
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		msg, err := resolve()
+		c <- result{msg, err}
+	}()
+	deadline := time.NewTimer(resolveTimeout)
+	defer deadline.Stop()
+	var stale <-chan time.Time
+	if answers.StaleTTL > 0 {
+		timer := time.NewTimer(staleAnswerTimeout)
+		defer timer.Stop()
+		stale = timer.C
+	}
+	for {
+		select {
+		case r := <-c:
+			if r.err == nil {
+				return r.msg, nil
+			}
+			if msg, ok := answers.GetStale(q); ok {
+				return msg, nil
+			}
+			return r.msg, r.err
+		case <-stale:
+			if msg, ok := answers.GetStale(q); ok {
+				return msg, nil
+			}
+			stale = nil
+		case <-deadline.C:
+			if msg, ok := answers.GetStale(q); ok {
+				return msg, nil
+			}
+			return dnsmessage.Message{}, fmt.Errorf("resolve %s: %w", q.Name, errDeadline)
+		}
+	}
+}
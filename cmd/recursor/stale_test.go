@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAnswerDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { resolveTimeout = timeout }(resolveTimeout)
+	resolveTimeout = 100 * time.Millisecond
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.deadline.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	// resolution which never finishes.
+	block := make(chan struct{})
+	defer close(block)
+	start := time.Now()
+	_, err := answerOrStale(q, func() (dnsmessage.Message, error) {
+		<-block
+		return dnsmessage.Message{}, nil
+	})
+	if !errors.Is(err, errDeadline) {
+		t.Errorf("got error %v, want %v", err, errDeadline)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("answered after %s, want about %s", d, resolveTimeout)
+	}
+
+	rmsg, err := answerOrStale(q, func() (dnsmessage.Message, error) {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}, nil
+	})
+	if err != nil || rmsg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("got %v, %v; want the resolved answer", rmsg.Header.RCode, err)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+var typeNames = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+	"SIG":   dns.TypeSIG,
+	"KEY":   dns.TypeKEY,
+}
+
+// readZone reads a zone from r in the master file format described in
+// RFC 1035 section 5. The zone's name is origin, which must be the
+// owner of exactly one SOA record in the file.
+// See readResources for the supported syntax.
+func readZone(r io.Reader, origin dnsmessage.Name) (*dns.Zone, error) {
+	rrs, err := readResources(r, origin)
+	if err != nil {
+		return nil, err
+	}
+	z := &dns.Zone{Name: origin}
+	var found bool
+	for _, rr := range rrs {
+		soa, ok := rr.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			z.Resources = append(z.Resources, rr)
+			continue
+		}
+		if !strings.EqualFold(rr.Header.Name.String(), origin.String()) {
+			return nil, fmt.Errorf("SOA record for %s not at zone apex %s", rr.Header.Name, origin)
+		}
+		if found {
+			return nil, errors.New("more than one SOA record")
+		}
+		z.SOA = *soa
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no SOA record for %s", origin)
+	}
+	return z, nil
+}
+
+// readResources reads resource records from r in the master file
+// format described in RFC 1035 section 5. Relative names are made
+// absolute with origin, which may be changed with an $ORIGIN directive.
+// Records without a TTL take the TTL set by a $TTL directive or,
+// failing that, the TTL of the previous record.
+// Records of types without a presentation format here may be written
+// in the generic format of RFC 3597, for example:
+//
+//	example.com. 3600 IN TYPE99 \# 4 0a000001
+//
+// The $INCLUDE directive is not supported.
+func readResources(r io.Reader, origin dnsmessage.Name) ([]dnsmessage.Resource, error) {
+	p := &zoneParser{origin: origin}
+	lines, err := scanZone(r)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dnsmessage.Resource
+	for _, l := range lines {
+		rr, ok, err := p.parse(l)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.n, err)
+		}
+		if ok {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+type zoneToken struct {
+	s      string
+	quoted bool
+}
+
+// A zoneLine is an entry in a master file, which may span
+// several lines of text in parentheses.
+type zoneLine struct {
+	n int // line number of the start of the entry
+	// indented is set if the entry starts with white space,
+	// in which case it has the previous entry's owner.
+	indented bool
+	tokens   []zoneToken
+}
+
+// scanZone splits the master file in r into entries, removing comments.
+func scanZone(r io.Reader) ([]zoneLine, error) {
+	sc := bufio.NewScanner(r)
+	var lines []zoneLine
+	var cur zoneLine
+	var depth int // of parentheses
+	var n int
+	for sc.Scan() {
+		n++
+		text := sc.Text()
+		if depth == 0 {
+			cur = zoneLine{n: n, indented: len(text) > 0 && (text[0] == ' ' || text[0] == '\t')}
+		}
+		for i := 0; i < len(text); {
+			switch c := text[i]; {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '(':
+				depth++
+				i++
+			case c == ')':
+				if depth == 0 {
+					return nil, fmt.Errorf("line %d: unbalanced parentheses", n)
+				}
+				depth--
+				i++
+			case c == '"':
+				s, end, err := scanQuoted(text, i+1)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				cur.tokens = append(cur.tokens, zoneToken{s: s, quoted: true})
+				i = end
+			default:
+				start := i
+				for i < len(text) && !strings.ContainsRune(" \t\r;()\"", rune(text[i])) {
+					if text[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				if i > len(text) {
+					i = len(text)
+				}
+				cur.tokens = append(cur.tokens, zoneToken{s: text[start:i]})
+			}
+		}
+		if depth == 0 && len(cur.tokens) > 0 {
+			lines = append(lines, cur)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", cur.n)
+	}
+	return lines, nil
+}
+
+// scanQuoted returns the unescaped contents of the quoted string
+// starting at text[i] and the index following the closing quote.
+func scanQuoted(text string, i int) (string, int, error) {
+	var b strings.Builder
+	for i < len(text) {
+		switch c := text[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+3 < len(text) && isDigits(text[i+1:i+4]) {
+				n, _ := strconv.Atoi(text[i+1 : i+4])
+				if n > 255 {
+					return "", 0, fmt.Errorf("bad escape \\%s", text[i+1:i+4])
+				}
+				b.WriteByte(byte(n))
+				i += 4
+				continue
+			}
+			if i+1 < len(text) {
+				b.WriteByte(text[i+1])
+			}
+			i += 2
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, errors.New("unterminated quoted string")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+type zoneParser struct {
+	origin   dnsmessage.Name
+	owner    dnsmessage.Name
+	hasOwner bool
+	// defaultTTL is set by the $TTL directive.
+	defaultTTL uint32
+	hasDefault bool
+	// lastTTL is the TTL of the previous record with one.
+	lastTTL uint32
+	hasLast bool
+}
+
+// parse returns the resource record in l. Directives such as
+// $ORIGIN change the parser's state and return false.
+func (p *zoneParser) parse(l zoneLine) (dnsmessage.Resource, bool, error) {
+	var rr dnsmessage.Resource
+	tokens := l.tokens
+	if first := tokens[0].s; !l.indented && strings.HasPrefix(first, "$") {
+		if len(tokens) != 2 {
+			return rr, false, fmt.Errorf("%s: want 1 argument, have %d", first, len(tokens)-1)
+		}
+		switch strings.ToUpper(first) {
+		case "$ORIGIN":
+			name, err := p.name(tokens[1].s)
+			if err != nil {
+				return rr, false, err
+			}
+			p.origin = name
+		case "$TTL":
+			ttl, err := parseTTL(tokens[1].s)
+			if err != nil {
+				return rr, false, err
+			}
+			p.defaultTTL, p.hasDefault = ttl, true
+		default:
+			return rr, false, fmt.Errorf("unsupported directive %s", first)
+		}
+		return rr, false, nil
+	}
+
+	if l.indented {
+		if !p.hasOwner {
+			return rr, false, errors.New("no owner name")
+		}
+	} else {
+		name, err := p.name(tokens[0].s)
+		if err != nil {
+			return rr, false, err
+		}
+		p.owner, p.hasOwner = name, true
+		tokens = tokens[1:]
+	}
+	rr.Header.Name = p.owner
+	rr.Header.Class = dnsmessage.ClassINET
+
+	// the TTL and class may come in either order before the type.
+	var ttlSet bool
+	for i := 0; i < 2 && len(tokens) > 0; i++ {
+		if strings.EqualFold(tokens[0].s, "IN") {
+			tokens = tokens[1:]
+		} else if ttl, err := parseTTL(tokens[0].s); err == nil && !ttlSet {
+			rr.Header.TTL, ttlSet = ttl, true
+			tokens = tokens[1:]
+		}
+	}
+	switch {
+	case ttlSet:
+		p.lastTTL, p.hasLast = rr.Header.TTL, true
+	case p.hasDefault:
+		rr.Header.TTL = p.defaultTTL
+	case p.hasLast:
+		// RFC 1035 section 5.1
+		rr.Header.TTL = p.lastTTL
+	}
+	if len(tokens) == 0 {
+		return rr, false, errors.New("missing type")
+	}
+	t, err := parseType(tokens[0].s)
+	if err != nil {
+		return rr, false, err
+	}
+	rr.Header.Type = t
+	rr.Body, err = p.rdata(t, tokens[1:])
+	if err != nil {
+		return rr, false, fmt.Errorf("%s record: %w", tokens[0].s, err)
+	}
+	if !ttlSet && !p.hasDefault && !p.hasLast {
+		// a SOA record may set the TTL of those that follow.
+		soa, ok := rr.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			return rr, false, errors.New("no TTL")
+		}
+		rr.Header.TTL = soa.MinTTL
+		p.lastTTL, p.hasLast = rr.Header.TTL, true
+	}
+	return rr, true, nil
+}
+
+// name returns the absolute name for s, which may be relative
+// to the parser's origin or "@" for the origin itself.
+func (p *zoneParser) name(s string) (dnsmessage.Name, error) {
+	if s == "@" {
+		return p.origin, nil
+	}
+	if !strings.HasSuffix(s, ".") || strings.HasSuffix(s, "\\.") {
+		if p.origin.Length == 0 {
+			return dnsmessage.Name{}, fmt.Errorf("relative name %s with no origin", s)
+		}
+		if p.origin.String() == "." {
+			s += "."
+		} else {
+			s += "." + p.origin.String()
+		}
+	}
+	return dnsmessage.NewName(s)
+}
+
+func parseType(s string) (dnsmessage.Type, error) {
+	if t, ok := typeNames[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	if len(s) > 4 && strings.EqualFold(s[:4], "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return dnsmessage.Type(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type %s", s)
+}
+
+// parseTTL parses a TTL in seconds, or in BIND's format of numbers
+// followed by units such as "1h30m".
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, n uint64
+	var digits bool
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("bad TTL %s", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			n *= 60
+		case 'h':
+			n *= 60 * 60
+		case 'd':
+			n *= 24 * 60 * 60
+		case 'w':
+			n *= 7 * 24 * 60 * 60
+		default:
+			return 0, fmt.Errorf("bad TTL %s", s)
+		}
+		total += n
+		n, digits = 0, false
+	}
+	if digits || total > 1<<32-1 {
+		return 0, fmt.Errorf("bad TTL %s", s)
+	}
+	return uint32(total), nil
+}
+
+func (p *zoneParser) rdata(t dnsmessage.Type, tokens []zoneToken) (dnsmessage.ResourceBody, error) {
+	if len(tokens) > 0 && tokens[0].s == `\#` {
+		return parseGeneric(t, tokens[1:])
+	}
+	want := map[dnsmessage.Type]int{
+		dnsmessage.TypeA:     1,
+		dnsmessage.TypeAAAA:  1,
+		dnsmessage.TypeNS:    1,
+		dnsmessage.TypeCNAME: 1,
+		dnsmessage.TypePTR:   1,
+		dnsmessage.TypeMX:    2,
+		dnsmessage.TypeSRV:   4,
+		dnsmessage.TypeSOA:   7,
+	}
+	if n, ok := want[t]; ok && len(tokens) != n {
+		return nil, fmt.Errorf("want %d fields, have %d", n, len(tokens))
+	}
+	switch t {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(tokens[0].s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("bad IPv4 address %s", tokens[0].s)
+		}
+		var a [4]byte
+		copy(a[:], ip)
+		return &dnsmessage.AResource{A: a}, nil
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(tokens[0].s)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("bad IPv6 address %s", tokens[0].s)
+		}
+		var a [16]byte
+		copy(a[:], ip)
+		return &dnsmessage.AAAAResource{AAAA: a}, nil
+	case dnsmessage.TypeNS:
+		name, err := p.name(tokens[0].s)
+		return &dnsmessage.NSResource{NS: name}, err
+	case dnsmessage.TypeCNAME:
+		name, err := p.name(tokens[0].s)
+		return &dnsmessage.CNAMEResource{CNAME: name}, err
+	case dnsmessage.TypePTR:
+		name, err := p.name(tokens[0].s)
+		return &dnsmessage.PTRResource{PTR: name}, err
+	case dnsmessage.TypeMX:
+		pref, err := strconv.ParseUint(tokens[0].s, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.name(tokens[1].s)
+		return &dnsmessage.MXResource{Pref: uint16(pref), MX: name}, err
+	case dnsmessage.TypeSRV:
+		var n [3]uint16
+		for i := range n {
+			v, err := strconv.ParseUint(tokens[i].s, 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = uint16(v)
+		}
+		name, err := p.name(tokens[3].s)
+		return &dnsmessage.SRVResource{Priority: n[0], Weight: n[1], Port: n[2], Target: name}, err
+	case dnsmessage.TypeSOA:
+		ns, err := p.name(tokens[0].s)
+		if err != nil {
+			return nil, err
+		}
+		mbox, err := p.name(tokens[1].s)
+		if err != nil {
+			return nil, err
+		}
+		serial, err := strconv.ParseUint(tokens[2].s, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		var times [4]uint32
+		for i := range times {
+			if times[i], err = parseTTL(tokens[3+i].s); err != nil {
+				return nil, err
+			}
+		}
+		return &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  uint32(serial),
+			Refresh: times[0],
+			Retry:   times[1],
+			Expire:  times[2],
+			MinTTL:  times[3],
+		}, nil
+	case dnsmessage.TypeTXT:
+		if len(tokens) == 0 {
+			return nil, errors.New("no strings")
+		}
+		var txt []string
+		for _, tok := range tokens {
+			if len(tok.s) > 255 {
+				return nil, fmt.Errorf("string longer than 255 bytes")
+			}
+			txt = append(txt, tok.s)
+		}
+		return &dnsmessage.TXTResource{TXT: txt}, nil
+	}
+	return nil, fmt.Errorf("no presentation format for type %d; use the generic format", t)
+}
+
+// parseGeneric parses record data in the format of RFC 3597 section 5:
+// the length of the data followed by the data in hexadecimal.
+func parseGeneric(t dnsmessage.Type, tokens []zoneToken) (dnsmessage.ResourceBody, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("missing data length")
+	}
+	n, err := strconv.ParseUint(tokens[0].s, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad data length: %w", err)
+	}
+	var s strings.Builder
+	for _, tok := range tokens[1:] {
+		s.WriteString(tok.s)
+	}
+	data, err := hex.DecodeString(s.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(n) {
+		return nil, fmt.Errorf("data length %d, want %d", len(data), n)
+	}
+	return &dnsmessage.UnknownResource{Type: t, Data: data}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"olowe.co/dns"
+)
+
+const testZoneFile = `$ORIGIN example.test.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		3600       ; refresh
+		15m        ; retry
+		1w         ; expire
+		300 )      ; minimum
+	NS	ns1
+	MX	10 mail
+ns1	A	192.0.2.1
+www	300	IN	A	192.0.2.2
+	IN	300	AAAA	2001:db8::2
+mail	A	192.0.2.3
+txt	TXT	"hello world" "semi;colon" unquoted
+_sip._tcp	SRV	10 20 5060 www
+alias	CNAME	www.example.test.
+key	KEY	\# 4 02000300
+`
+
+func TestReadZone(t *testing.T) {
+	z, err := readZone(strings.NewReader(testZoneFile), dnsmessage.MustNewName("example.test."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns1.example.test."),
+		MBox:    dnsmessage.MustNewName("hostmaster.example.test."),
+		Serial:  2024010101,
+		Refresh: 3600,
+		Retry:   900,
+		Expire:  604800,
+		MinTTL:  300,
+	}
+	if z.SOA != want {
+		t.Errorf("got SOA %+v, want %+v", z.SOA, want)
+	}
+	if len(z.Resources) != 10 {
+		t.Fatalf("got %d resources, want 10", len(z.Resources))
+	}
+	tests := []struct {
+		i    int
+		name string
+		t    dnsmessage.Type
+		ttl  uint32
+	}{
+		{0, "example.test.", dnsmessage.TypeNS, 3600},
+		{1, "example.test.", dnsmessage.TypeMX, 3600},
+		{3, "www.example.test.", dnsmessage.TypeA, 300},
+		{4, "www.example.test.", dnsmessage.TypeAAAA, 300},
+		{7, "_sip._tcp.example.test.", dnsmessage.TypeSRV, 3600},
+		{9, "key.example.test.", dns.TypeKEY, 3600},
+	}
+	for _, tt := range tests {
+		h := z.Resources[tt.i].Header
+		if h.Name.String() != tt.name || h.Type != tt.t || h.TTL != tt.ttl {
+			t.Errorf("resource %d: got %s %s %d, want %s %s %d", tt.i, h.Name, h.Type, h.TTL, tt.name, tt.t, tt.ttl)
+		}
+	}
+	txt := z.Resources[6].Body.(*dnsmessage.TXTResource)
+	if got := strings.Join(txt.TXT, "|"); got != "hello world|semi;colon|unquoted" {
+		t.Errorf("got TXT strings %q", txt.TXT)
+	}
+	key := z.Resources[9].Body.(*dnsmessage.UnknownResource)
+	if string(key.Data) != "\x02\x00\x03\x00" {
+		t.Errorf("got KEY data %x", key.Data)
+	}
+	// check everything we parsed can be sent.
+	msg := dnsmessage.Message{Answers: z.Resources}
+	if _, err := msg.Pack(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadResourcesInheritTTL(t *testing.T) {
+	in := "a.example.test. 60 A 192.0.2.1\nb.example.test. A 192.0.2.2\n"
+	rrs, err := readResources(strings.NewReader(in), dnsmessage.Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rrs[1].Header.TTL != 60 {
+		t.Errorf("got TTL %d, want 60 from previous record", rrs[1].Header.TTL)
+	}
+}
+
+func TestReadResourcesErrors(t *testing.T) {
+	tests := []string{
+		"www.example.test. A 192.0.2.1",            // no TTL
+		"www 60 A 192.0.2.1",                       // relative name without origin
+		"www.example.test. 60 A 2001:db8::1",       // wrong address family
+		"www.example.test. 60 BOGUS x",             // unknown type
+		"www.example.test. 60 TXT \"unterminated",  // bad quoting
+		"www.example.test. 60 SOA ( a. b. 1 2 3 4", // unbalanced parentheses
+		"$INCLUDE other.zone",
+		"www.example.test. 60 TYPE99 \\# 2 0a", // wrong length
+	}
+	for _, in := range tests {
+		if _, err := readResources(strings.NewReader(in), dnsmessage.Name{}); err == nil {
+			t.Errorf("nil error reading %q", in)
+		}
+	}
+}
@@ -61,6 +61,44 @@ A Server may be created with a custom net.Listener:
 	srv := &dns.Server{Handler: myHandler}
 	log.Fatal(srv.Serve(l))
 
+A Server may also act as a primary server for a set of Zones,
+answering full (AXFR) and incremental (IXFR) zone transfers over TCP
+from permitted networks:
+
+	_, secondaries, err := net.ParseCIDR("192.0.2.0/24")
+	srv := &dns.Server{Zones: []*dns.Zone{zone}, AllowTransfer: []*net.IPNet{secondaries}}
+
+A Secondary keeps a Zone in sync with a primary server:
+
+	sec := &dns.Secondary{Zone: &dns.Zone{Name: name}, Primaries: []string{"192.0.2.1:domain"}}
+	go sec.Run()
+	srv := &dns.Server{Zones: []*dns.Zone{sec.Zone}}
+
+Records may be changed on a server supporting dynamic updates
+(RFC 2136) with SendUpdate:
+
+	u := &dns.Update{Zone: dnsmessage.MustNewName("example.com.")}
+	u.NameNotInUse(name)
+	u.Add(rr)
+	if err := dns.SendUpdate(u, "192.0.2.1:domain"); errors.Is(err, dns.ErrYXDomain) {
+		// name already in use
+	}
+
+A Server applies updates to its Zones as permitted by each zone's
+AllowUpdate policies.
+
+An ACL wraps a Handler to control which clients may use it, such as
+to keep a recursive resolver from being open to the whole Internet:
+
+	acl := append(dns.ACL{}, dns.DefaultACL...)
+	acl = append(acl, dns.ACLRule{Net: trusted, Action: dns.ACLAllow})
+	srv := &dns.Server{Handler: acl.Handler(myHandler)}
+
+Views give clients in different networks different answers:
+
+	views := dns.Views{{Name: "office", Nets: officeNets, Handler: officeHandler}}
+	srv := &dns.Server{Handler: views.Handler(myHandler)}
+
 */
 package dns
 
@@ -71,6 +109,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -81,12 +120,16 @@ const MediaType string = "application/dns-message"
 const MaxMsgSize int = 65535 // max size of a message in bytes
 
 const OpCodeQUERY dnsmessage.OpCode = 0
+const OpCodeNOTIFY dnsmessage.OpCode = 4 // RFC 1996
 
 var errMismatchedID = errors.New("mismatched message id")
 
 var randomsrc *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var randommu sync.Mutex
 
 func newID() uint16 {
+	randommu.Lock()
+	defer randommu.Unlock()
 	return uint16(randomsrc.Intn(65535))
 }
 
@@ -100,6 +143,17 @@ func Ask(q dnsmessage.Question, addr string) (dnsmessage.Message, error) {
 	return Exchange(qmsg, addr)
 }
 
+// AskTimeout is like Ask but sends q over the named network,
+// such as "udp4" or "tcp", and gives up if no reply is received
+// within timeout.
+func AskTimeout(q dnsmessage.Question, network, addr string, timeout time.Duration) (dnsmessage.Message, error) {
+	qmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newID()},
+		Questions: []dnsmessage.Question{q},
+	}
+	return exchangeTimeout(qmsg, network, addr, timeout)
+}
+
 // Ask sends a message with q to addr and returns its response.
 // The exchange is unencrypted using TCP.
 func AskTCP(q dnsmessage.Question, addr string) (dnsmessage.Message, error) {
@@ -151,6 +205,32 @@ func ExchangeTLS(msg dnsmessage.Message, addr string) (dnsmessage.Message, error
 	return exchange(msg, conn)
 }
 
+// ExchangeTimeout is like Exchange but sends msg over the named
+// network and gives up if no reply is received within timeout.
+// The network is one understood by net.Dial such as "udp" or "tcp4",
+// or "tcp-tls" for DNS over TLS.
+func ExchangeTimeout(msg dnsmessage.Message, network, addr string, timeout time.Duration) (dnsmessage.Message, error) {
+	return exchangeTimeout(msg, network, addr, timeout)
+}
+
+func exchangeTimeout(msg dnsmessage.Message, network, addr string, timeout time.Duration) (dnsmessage.Message, error) {
+	var conn net.Conn
+	var err error
+	if network == "tcp-tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, nil)
+	} else {
+		conn, err = net.DialTimeout(network, addr, timeout)
+	}
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	return exchange(msg, conn)
+}
+
 func exchange(msg dnsmessage.Message, conn net.Conn) (dnsmessage.Message, error) {
 	if err := sendMsg(msg, conn); err != nil {
 		return dnsmessage.Message{}, err
@@ -200,6 +280,15 @@ func sendMsgTo(msg dnsmessage.Message, conn net.PacketConn, addr net.Addr) error
 }
 
 func receive(conn net.Conn) (dnsmessage.Message, error) {
+	b, err := receiveBytes(conn)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	return unpack(b)
+}
+
+// receiveBytes reads a single DNS message from conn in wire format.
+func receiveBytes(conn net.Conn) ([]byte, error) {
 	var buf []byte
 	var n int
 	var err error
@@ -207,12 +296,12 @@ func receive(conn net.Conn) (dnsmessage.Message, error) {
 		buf = make([]byte, 512)
 		n, err = conn.Read(buf)
 		if err != nil {
-			return dnsmessage.Message{}, err
+			return nil, err
 		}
 	} else {
 		buf = make([]byte, 1280)
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return dnsmessage.Message{}, fmt.Errorf("read length: %w", err)
+			return nil, fmt.Errorf("read length: %w", err)
 		}
 		l := int(buf[0])<<8 | int(buf[1])
 		if l > len(buf) {
@@ -220,12 +309,59 @@ func receive(conn net.Conn) (dnsmessage.Message, error) {
 		}
 		n, err = io.ReadFull(conn, buf[:l])
 		if err != nil {
-			return dnsmessage.Message{}, fmt.Errorf("read after length: %w", err)
+			return nil, fmt.Errorf("read after length: %w", err)
 		}
 	}
+	return buf[:n], nil
+}
+
+// unpack parses the DNS message in b. Unlike dnsmessage.Message.Unpack,
+// resources of class ANY or NONE with no data, as sent in dynamic
+// updates (RFC 2136), are parsed as an UnknownResource of their type.
+// On error, the parts of the message parsed so far are returned.
+func unpack(b []byte) (dnsmessage.Message, error) {
+	var p dnsmessage.Parser
 	var msg dnsmessage.Message
-	if err := msg.Unpack(buf[:n]); err != nil {
-		return dnsmessage.Message{}, err
+	var err error
+	if msg.Header, err = p.Start(b); err != nil {
+		return msg, err
+	}
+	if msg.Questions, err = p.AllQuestions(); err != nil {
+		return msg, err
+	}
+	if msg.Answers, err = unpackSection(p.AnswerHeader, p.Answer, p.SkipAnswer); err != nil {
+		return msg, err
+	}
+	if msg.Authorities, err = unpackSection(p.AuthorityHeader, p.Authority, p.SkipAuthority); err != nil {
+		return msg, err
+	}
+	if msg.Additionals, err = unpackSection(p.AdditionalHeader, p.Additional, p.SkipAdditional); err != nil {
+		return msg, err
 	}
 	return msg, nil
 }
+
+func unpackSection(header func() (dnsmessage.ResourceHeader, error), resource func() (dnsmessage.Resource, error), skip func() error) ([]dnsmessage.Resource, error) {
+	var rrs []dnsmessage.Resource
+	for {
+		h, err := header()
+		if err == dnsmessage.ErrSectionDone {
+			return rrs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		empty := h.Length == 0 && h.Type != dnsmessage.TypeOPT
+		if empty && (h.Class == dnsmessage.ClassANY || h.Class == ClassNONE) {
+			if err := skip(); err != nil {
+				return nil, err
+			}
+			rrs = append(rrs, dnsmessage.Resource{Header: h, Body: &dnsmessage.UnknownResource{Type: h.Type}})
+			continue
+		}
+		r, err := resource()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, r)
+	}
+}
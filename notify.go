@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// notifyTimeout is how long a Notifier first waits for a secondary
+// to acknowledge a NOTIFY message. The wait is doubled after each
+// unanswered attempt.
+const notifyTimeout = 2 * time.Second
+
+// defaultNotifyRetries is the number of times a NOTIFY message is
+// retransmitted if a Notifier's Retries is unset.
+const defaultNotifyRetries = 5
+
+// A Notifier sends NOTIFY messages (RFC 1996) to secondary servers
+// whenever the serial number of Zone changes, prompting them to
+// transfer the new version of the zone.
+type Notifier struct {
+	Zone *Zone
+	// Secondaries are the addresses of the servers to notify.
+	Secondaries []string
+	// Retries is the number of times an unacknowledged message is
+	// retransmitted. If zero, a default of 5 is used.
+	Retries int
+
+	once    sync.Once
+	done    chan struct{}
+	mu      sync.Mutex
+	results map[string]NotifyResult
+}
+
+// NotifyResult is the outcome of notifying a secondary of a change to a zone.
+type NotifyResult struct {
+	// Serial is the serial number of the zone sent to the secondary.
+	Serial uint32
+	// Time is when the secondary acknowledged the message, or when
+	// the last attempt was made if Err is not nil.
+	Time time.Time
+	// Attempts is the number of messages sent.
+	Attempts int
+	// Err is the error from the last attempt, or nil if the secondary
+	// acknowledged the message.
+	Err error
+}
+
+func (n *Notifier) init() {
+	n.once.Do(func() {
+		n.done = make(chan struct{})
+		n.results = make(map[string]NotifyResult)
+	})
+}
+
+// Run notifies secondaries of the current version of the zone, then
+// of each change to the zone's serial number until Close is called.
+func (n *Notifier) Run() {
+	n.init()
+	changes := n.Zone.watch()
+	last := n.Zone.Serial()
+	n.Notify()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-changes:
+		}
+		if serial := n.Zone.Serial(); serial != last {
+			last = serial
+			n.Notify()
+		}
+	}
+}
+
+// Close stops notifying secondaries of changes to the zone.
+func (n *Notifier) Close() error {
+	n.init()
+	close(n.done)
+	return nil
+}
+
+// Notify sends a NOTIFY message for the current version of the zone
+// to each secondary concurrently, returning once each has acknowledged
+// the message or all attempts have failed.
+func (n *Notifier) Notify() map[string]NotifyResult {
+	n.init()
+	n.Zone.mu.RLock()
+	soa := n.Zone.soaResource()
+	n.Zone.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, addr := range n.Secondaries {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			res := n.notify(addr, soa)
+			n.mu.Lock()
+			n.results[addr] = res
+			n.mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+	return n.Results()
+}
+
+// Results returns the outcome of the most recent notification sent to
+// each secondary.
+func (n *Notifier) Results() map[string]NotifyResult {
+	n.init()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	results := make(map[string]NotifyResult, len(n.results))
+	for addr, res := range n.results {
+		results[addr] = res
+	}
+	return results
+}
+
+// notify sends the SOA record soa to addr in a NOTIFY message, retrying
+// with exponential backoff until the message is acknowledged.
+func (n *Notifier) notify(addr string, soa dnsmessage.Resource) NotifyResult {
+	body := soa.Body.(*dnsmessage.SOAResource)
+	res := NotifyResult{Serial: body.Serial}
+	retries := n.Retries
+	if retries <= 0 {
+		retries = defaultNotifyRetries
+	}
+	q := dnsmessage.Question{Name: soa.Header.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newID(), OpCode: OpCodeNOTIFY, Authoritative: true},
+		Questions: []dnsmessage.Question{q},
+		Answers:   []dnsmessage.Resource{soa},
+	}
+	timeout := notifyTimeout
+	for res.Attempts <= retries {
+		res.Attempts++
+		start := time.Now()
+		rmsg, err := exchangeTimeout(qmsg, "udp", addr, timeout)
+		res.Time = time.Now()
+		if err == nil && rmsg.Header.RCode != dnsmessage.RCodeSuccess {
+			err = fmt.Errorf("notify %s: %s", q.Name, rmsg.Header.RCode)
+		} else if err == nil && rmsg.Header.OpCode != OpCodeNOTIFY {
+			err = fmt.Errorf("notify %s: reply has opcode %d", q.Name, rmsg.Header.OpCode)
+		}
+		res.Err = err
+		if err == nil || res.Attempts > retries {
+			break
+		}
+		// Errors such as refused connections return early;
+		// back off for the rest of the timeout anyway.
+		wait := time.NewTimer(timeout - time.Since(start))
+		select {
+		case <-n.done:
+			wait.Stop()
+			return res
+		case <-wait.C:
+		}
+		timeout *= 2
+	}
+	return res
+}
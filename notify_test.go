@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNotifier(t *testing.T) {
+	primary := testZone()
+	paddr := servePrimary(t, primary)
+
+	zone := &Zone{Name: primary.Name}
+	sec := &Secondary{Zone: zone, Primaries: []string{paddr}}
+	go sec.Run()
+	defer sec.Close()
+	waitSerial(t, zone, 1)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{zone}}
+	go srv.ServePacket(conn)
+
+	n := &Notifier{Zone: primary, Secondaries: []string{conn.LocalAddr().String()}}
+	go n.Run()
+	defer n.Close()
+
+	soa := primary.SOA
+	soa.Serial++
+	primary.Change(soa, nil, []dnsmessage.Resource{testA("new.example.test.", 192, 0, 2, 9)})
+	waitSerial(t, zone, 2)
+
+	results := n.Notify()
+	res, ok := results[conn.LocalAddr().String()]
+	if !ok {
+		t.Fatal("no result for secondary")
+	}
+	if res.Err != nil || res.Serial != 2 || res.Attempts != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestNotifyGiveUp(t *testing.T) {
+	// nothing listens at addr, so each attempt fails at once.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	n := &Notifier{Zone: testZone(), Secondaries: []string{addr}, Retries: 1}
+	start := time.Now()
+	res := n.Notify()[addr]
+	if res.Err == nil || res.Attempts != 2 {
+		t.Errorf("got %d attempts with error %v, want 2 attempts and an error", res.Attempts, res.Err)
+	}
+	// only the backoff between the two attempts should be waited.
+	if d := time.Since(start); d > notifyTimeout+time.Second {
+		t.Errorf("gave up after %s, want about %s", d, notifyTimeout)
+	}
+}
@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultRetry is how long a Secondary waits between attempts to
+// refresh a zone whose SOA record does not give an interval.
+const defaultRetry = time.Minute
+
+// refreshTimeout is the longest time a Secondary waits for a primary
+// to answer a query for the zone's SOA record.
+const refreshTimeout = 5 * time.Second
+
+// A Secondary keeps Zone up to date with a primary server using zone
+// transfers. The primary is polled for changes to the zone's serial
+// number as scheduled by the refresh and retry intervals of the SOA
+// record, or sooner when the primary sends a NOTIFY message (RFC 1996).
+// If the zone cannot be refreshed within its expire interval, it
+// is no longer answered by a Server.
+type Secondary struct {
+	Zone *Zone
+	// Loaded reports that Zone already holds the zone's data, such as
+	// read from local storage, which is answered until it expires.
+	// Otherwise the zone is not answered until it has been transferred
+	// from a primary.
+	Loaded bool
+	// Primaries are the addresses of the servers from which Zone
+	// is transferred, tried in order.
+	Primaries []string
+	// Key, if not nil, signs requests to the primaries using TSIG.
+	Key *Key
+	// ErrorLog specifies an optional logger for errors refreshing
+	// the zone. If nil, errors are not logged.
+	ErrorLog *log.Logger
+
+	once      sync.Once
+	closeOnce sync.Once
+	notify    chan struct{}
+	done      chan struct{}
+	loaded    bool
+}
+
+func (s *Secondary) init() {
+	s.once.Do(func() {
+		s.notify = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		s.Zone.mu.Lock()
+		s.Zone.secondary = s
+		s.loaded = s.Loaded
+		s.Zone.expired = !s.loaded
+		s.Zone.mu.Unlock()
+	})
+}
+
+// Run keeps the zone up to date until Close is called.
+func (s *Secondary) Run() {
+	s.init()
+	lastRefresh := time.Now()
+	for {
+		refresh, retry, expire := s.timers()
+		wait := refresh
+		if err := s.refresh(); err != nil {
+			if s.ErrorLog != nil {
+				s.ErrorLog.Printf("refresh %s: %v", s.Zone.Name, err)
+			}
+			wait = retry
+			if time.Since(lastRefresh) > expire {
+				s.setExpired(true)
+			}
+		} else {
+			lastRefresh = time.Now()
+			s.setExpired(false)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Notify schedules an immediate refresh of the zone.
+func (s *Secondary) Notify() {
+	s.init()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+		// a refresh is already pending.
+	}
+}
+
+// Close stops refreshing the zone. The zone continues to be served
+// until it expires. Calling Close more than once has no further effect.
+func (s *Secondary) Close() error {
+	s.init()
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// timers returns the refresh, retry and expire intervals from the
+// zone's SOA record.
+func (s *Secondary) timers() (refresh, retry, expire time.Duration) {
+	s.Zone.mu.RLock()
+	defer s.Zone.mu.RUnlock()
+	soa := s.Zone.SOA
+	return interval(soa.Refresh), interval(soa.Retry), interval(soa.Expire)
+}
+
+func interval(seconds uint32) time.Duration {
+	if seconds == 0 {
+		return defaultRetry
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (s *Secondary) setExpired(expired bool) {
+	s.Zone.mu.Lock()
+	s.Zone.expired = expired || !s.loaded
+	s.Zone.mu.Unlock()
+}
+
+// refresh brings the zone up to date from the first primary which
+// responds.
+func (s *Secondary) refresh() error {
+	err := fmt.Errorf("no primaries")
+	for _, addr := range s.Primaries {
+		if err = s.refreshFrom(addr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *Secondary) refreshFrom(addr string) error {
+	z := s.Zone
+	if !s.loaded {
+		if err := z.axfr(addr, s.Key); err != nil {
+			return err
+		}
+		s.loaded = true
+		return nil
+	}
+	q := dnsmessage.Question{Name: z.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newID()},
+		Questions: []dnsmessage.Question{q},
+	}
+	rmsg, err := exchangeKey(qmsg, "udp", addr, s.Key, refreshTimeout)
+	if err != nil {
+		return err
+	}
+	if rmsg.Header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("query SOA: %s", rmsg.Header.RCode)
+	}
+	var soa *dnsmessage.SOAResource
+	for _, r := range rmsg.Answers {
+		if b, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			soa = b
+			break
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("query SOA: no SOA record in answer")
+	}
+	if !serialLess(z.Serial(), soa.Serial) {
+		return nil
+	}
+	return z.ixfr(addr, s.Key)
+}
+
+// fromPrimary reports whether ip is the address of one of the primaries.
+func (s *Secondary) fromPrimary(ip net.IP) bool {
+	for _, addr := range s.Primaries {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if pip := net.ParseIP(host); pip != nil {
+			if pip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, pip := range ips {
+			if pip.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notified answers a NOTIFY message for z, scheduling a refresh if z
+// is kept up to date by a Secondary and the message was sent by one of
+// its primaries.
+func notified(w *response, msg *dnsmessage.Message, z *Zone) {
+	z.mu.RLock()
+	s := z.secondary
+	z.mu.RUnlock()
+	if s == nil || !s.fromPrimary(addrIP(w.RemoteAddr())) {
+		Refuse(w, msg)
+		return
+	}
+	s.Notify()
+	w.WriteMsg(dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            msg.Header.ID,
+			Response:      true,
+			OpCode:        OpCodeNOTIFY,
+			Authoritative: true,
+		},
+		Questions: msg.Questions,
+	})
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSerialLess(t *testing.T) {
+	var tests = []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{0xffffffff, 0, true},
+		{0xfffffff0, 10, true},
+		{10, 0xfffffff0, false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("serialLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
+
+// servePrimary serves z over both UDP and TCP on the same loopback
+// address, returning the address.
+func servePrimary(t *testing.T, z *Zone) string {
+	addr := serveTestZone(t, z)
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	srv := &Server{Zones: []*Zone{z}}
+	go srv.ServePacket(conn)
+	return addr
+}
+
+func waitSerial(t *testing.T, z *Zone, serial uint32) {
+	for i := 0; i < 100; i++ {
+		z.mu.RLock()
+		ok := z.SOA.Serial == serial && !z.expired
+		z.mu.RUnlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("zone serial %d not refreshed to %d", z.Serial(), serial)
+}
+
+func TestSecondary(t *testing.T) {
+	primary := testZone()
+	paddr := servePrimary(t, primary)
+
+	zone := &Zone{Name: primary.Name}
+	sec := &Secondary{Zone: zone, Primaries: []string{paddr}}
+	go sec.Run()
+	defer sec.Close()
+	waitSerial(t, zone, 1)
+	if len(zone.Resources) != len(primary.Resources) {
+		t.Errorf("transferred %d resources, want %d", len(zone.Resources), len(primary.Resources))
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{zone}}
+	go srv.ServePacket(conn)
+
+	soa := primary.SOA
+	soa.Serial++
+	added := testA("new.example.test.", 192, 0, 2, 9)
+	primary.Change(soa, nil, []dnsmessage.Resource{added})
+
+	notify := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 9, OpCode: OpCodeNOTIFY, Authoritative: true},
+		Questions: []dnsmessage.Question{
+			{Name: zone.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET},
+		},
+	}
+	rmsg, err := Exchange(notify, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rmsg.Header.RCode != dnsmessage.RCodeSuccess || rmsg.Header.OpCode != OpCodeNOTIFY {
+		t.Errorf("unexpected reply to notify: %+v", rmsg.Header)
+	}
+	waitSerial(t, zone, 2)
+	q := dnsmessage.Question{Name: added.Header.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rmsg, err = Ask(q, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rmsg.Answers) != 1 || !rmsg.Header.Authoritative {
+		t.Errorf("secondary did not answer with new record: %+v", rmsg)
+	}
+}
+
+func TestExpiredSecondary(t *testing.T) {
+	zone := testZone()
+	sec := &Secondary{Zone: zone}
+	sec.init()
+	sec.setExpired(true)
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	rmsg := zone.answer(&dnsmessage.Message{Questions: []dnsmessage.Question{q}})
+	if rmsg.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("expired zone answered with rcode %s", rmsg.Header.RCode)
+	}
+}
+
+func TestLoadedSecondary(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	for _, loaded := range []bool{true, false} {
+		zone := testZone()
+		sec := &Secondary{Zone: zone, Loaded: loaded}
+		sec.init()
+		rmsg := zone.answer(&dnsmessage.Message{Questions: []dnsmessage.Question{q}})
+		if served := rmsg.Header.RCode != dnsmessage.RCodeServerFailure; served != loaded {
+			t.Errorf("loaded %v: zone served %v before transfer", loaded, served)
+		}
+	}
+}
+
+func TestCloseSecondaryTwice(t *testing.T) {
+	sec := &Secondary{Zone: testZone()}
+	if err := sec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sec.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
@@ -2,16 +2,12 @@ package dns
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-type Zone struct {
-	Name      dnsmessage.Name
-	SOA       dnsmessage.SOAResource
-	Resources []dnsmessage.Resource
-}
-
 // Server contains settings for running a DNS server. An empty Server
 // with a nil Handler is a valid configuration.
 type Server struct {
@@ -20,15 +16,38 @@ type Server struct {
 	// Handler is the function which responds to each DNS request
 	// received by the server.
 	Handler Handler
+	// Zones are answered authoritatively by the server and may be
+	// transferred (AXFR and IXFR) by clients in AllowTransfer.
+	// Requests for names outside of Zones are passed to Handler.
+	Zones []*Zone
+	// AllowTransfer lists the networks whose clients may transfer Zones.
+	// If empty, all transfers are refused.
+	AllowTransfer []*net.IPNet
+	// Keys holds the keys with which requests may be signed using TSIG.
+	// Replies to signed requests are signed with the same key.
+	// Requests signed with unknown keys or invalid signatures are
+	// answered with a NOTAUTH response and are not passed to Handler.
+	// Requests signed with SIG(0) are verified against the KEY records
+	// of Zones in the same way.
+	Keys KeyRing
 }
 
 type response struct {
 	raddr net.Addr
 	pconn net.PacketConn
 	conn  net.Conn
+	// key is the name of the key which authenticated the request, if any.
+	key string
+	// tsig is set if replies must be signed.
+	tsig *tsigState
 }
 
 func (r *response) Write(p []byte) (n int, err error) {
+	if r.tsig != nil {
+		if p, err = r.tsig.sign(p); err != nil {
+			return 0, err
+		}
+	}
 	if r.pconn != nil {
 		return r.pconn.WriteTo(p, r.raddr)
 	}
@@ -36,12 +55,56 @@ func (r *response) Write(p []byte) (n int, err error) {
 }
 
 func (r *response) WriteMsg(msg dnsmessage.Message) error {
+	if r.pconn != nil {
+		var err error
+		if msg, err = truncate(msg, maxUDPSize); err != nil {
+			return err
+		}
+	}
+	if r.tsig != nil {
+		b, err := msg.Pack()
+		if err != nil {
+			return err
+		}
+		_, err = r.Write(b)
+		return err
+	}
 	if r.pconn != nil {
 		return sendMsgTo(msg, r.pconn, r.raddr)
 	}
 	return sendMsg(msg, r.conn)
 }
 
+// RemoteAddr returns the address of the client which sent the request.
+func (r *response) RemoteAddr() net.Addr {
+	if r.pconn != nil {
+		return r.raddr
+	}
+	return r.conn.RemoteAddr()
+}
+
+// maxUDPSize is the largest message sent over UDP (RFC 1035, section 4.2.1).
+const maxUDPSize = 512
+
+// truncate returns msg trimmed to fit in size bytes once packed.
+// Additional records are dropped first. If the message is still too
+// large, the answer and authority sections are dropped too and the TC
+// bit set so that the client retries over TCP (RFC 2181, section 9).
+func truncate(msg dnsmessage.Message, size int) (dnsmessage.Message, error) {
+	b, err := msg.Pack()
+	if err != nil || len(b) <= size {
+		return msg, err
+	}
+	msg.Additionals = nil
+	if b, err = msg.Pack(); err != nil || len(b) <= size {
+		return msg, err
+	}
+	msg.Header.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	return msg, nil
+}
+
 // The ResponseWriter interface is used by a Handler to reply to
 // DNS requests.
 type ResponseWriter interface {
@@ -59,22 +122,17 @@ func (srv *Server) ServePacket(conn net.PacketConn) error {
 	if srv.Handler == nil {
 		srv.Handler = DefaultHandler
 	}
+	// requests may be larger than maxUDPSize, such as those signed with TSIG.
+	buf := make([]byte, 65535)
 	for {
-		buf := make([]byte, 512)
 		n, raddr, err := conn.ReadFrom(buf)
 		if err != nil {
 			return err
 		}
-		go func() {
-			var msg dnsmessage.Message
-			if err := msg.Unpack(buf[:n]); err != nil {
-				msg.Header.RCode = dnsmessage.RCodeRefused
-				sendMsgTo(msg, conn, raddr)
-				return
-			}
-			resp := &response{raddr: raddr, pconn: conn}
-			srv.Handler(resp, &msg)
-		}()
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		resp := &response{raddr: raddr, pconn: conn}
+		go srv.serve(resp, b)
 	}
 	return nil
 }
@@ -89,9 +147,152 @@ func (srv *Server) Serve(l net.Listener) error {
 		if err != nil {
 			return err
 		}
-		msg, _ := receive(conn)
-		resp := &response{conn: conn}
-		go srv.Handler(resp, &msg)
+		go srv.serveConn(conn)
+	}
+}
+
+// idleTimeout is how long a stream connection may wait for a request
+// before the server closes it (RFC 7766, section 6.2.3).
+const idleTimeout = 10 * time.Second
+
+// serveConn handles requests on conn until the client closes it or it
+// is idle for idleTimeout. Requests may be pipelined; each is handled
+// in a new goroutine, so replies may be sent out of order.
+func (srv *Server) serveConn(conn net.Conn) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		b, err := receiveBytes(conn)
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serve(&response{conn: conn}, b)
+		}()
+	}
+}
+
+// serve unpacks and verifies the request b before handling it.
+func (srv *Server) serve(w *response, b []byte) {
+	msg, err := unpack(b)
+	if err != nil {
+		msg.Header.RCode = dnsmessage.RCodeRefused
+		w.WriteMsg(msg)
+		return
+	}
+	if n := len(msg.Additionals); n > 0 && msg.Additionals[n-1].Header.Type == TypeTSIG {
+		msg.Additionals = msg.Additionals[:n-1]
+		if !srv.verify(w, b, &msg) {
+			return
+		}
+	} else if n > 0 && isSIG0(msg.Additionals[n-1]) {
+		msg.Additionals = msg.Additionals[:n-1]
+		if !srv.verifySIG0(w, b, &msg) {
+			return
+		}
+	}
+	srv.handle(w, &msg)
+}
+
+// verify checks the TSIG record of the request b, arranging for
+// replies to be signed. If the request fails verification, an error
+// is returned to the client and false is returned.
+func (srv *Server) verify(w *response, b []byte, msg *dnsmessage.Message) bool {
+	_, t, k, err := verifyTSIG(b, srv.Keys, nil, false)
+	if err == nil {
+		w.key = k.Name.String()
+		w.tsig = &tsigState{key: k, mac: t.mac}
+		return true
+	}
+	if k == nil {
+		// reply naming the unknown key, but with an empty MAC.
+		k = &Key{Name: t.name, Algorithm: t.algorithm}
+	}
+	w.tsig = &tsigState{key: k, mac: t.mac}
+	switch err {
+	case ErrBadKey:
+		w.tsig.err = RCodeBadKey
+	case ErrBadTime:
+		w.tsig.err = RCodeBadTime
+	default:
+		w.tsig.err = RCodeBadSig
+	}
+	respError(w, msg, RCodeNotAuth)
+	return false
+}
+
+// verifySIG0 checks the SIG(0) record of the request b against the
+// KEY records of the server's Zones. If the request fails verification,
+// a NOTAUTH response is returned to the client and false is returned.
+func (srv *Server) verifySIG0(w *response, b []byte, msg *dnsmessage.Message) bool {
+	keys := func(name dnsmessage.Name) []dnsmessage.Resource {
+		z := srv.zone(name)
+		if z == nil {
+			return nil
+		}
+		z.mu.RLock()
+		defer z.mu.RUnlock()
+		return z.lookup(name, TypeKEY)
+	}
+	signer, err := verifySIG0(b, keys)
+	if err != nil {
+		respError(w, msg, RCodeNotAuth)
+		return false
+	}
+	w.key = signer.String()
+	return true
+}
+
+// handle passes msg to the Handler unless it concerns one of the
+// server's Zones.
+func (srv *Server) handle(w *response, msg *dnsmessage.Message) {
+	if len(msg.Questions) == 1 {
+		if z := srv.zone(msg.Questions[0].Name); z != nil {
+			srv.serveZone(w, msg, z)
+			return
+		}
+	}
+	srv.Handler(w, msg)
+}
+
+// zone returns the closest of the server's zones enclosing name,
+// or nil if there is none.
+func (srv *Server) zone(name dnsmessage.Name) *Zone {
+	var closest *Zone
+	for _, z := range srv.Zones {
+		if !IsSubdomain(name, z.Name) {
+			continue
+		}
+		if closest == nil || IsSubdomain(z.Name, closest.Name) {
+			closest = z
+		}
+	}
+	return closest
+}
+
+func (srv *Server) serveZone(w *response, msg *dnsmessage.Message, z *Zone) {
+	q := msg.Questions[0]
+	switch {
+	case msg.Header.OpCode == OpCodeNOTIFY:
+		notified(w, msg, z)
+	case msg.Header.OpCode == OpCodeUPDATE:
+		update(w, msg, z)
+	case msg.Header.OpCode != OpCodeQUERY:
+		NotImplemented(w, msg)
+	case q.Type == dnsmessage.TypeAXFR || q.Type == TypeIXFR:
+		if !equalName(q.Name, z.Name) {
+			Refuse(w, msg)
+			return
+		}
+		srv.transfer(w, msg, z)
+	default:
+		w.WriteMsg(z.answer(msg))
 	}
 }
 
@@ -143,6 +344,7 @@ func respError(w ResponseWriter, msg *dnsmessage.Message, rcode dnsmessage.RCode
 		Header: dnsmessage.Header{
 			ID:               msg.Header.ID,
 			Response:         true,
+			OpCode:           msg.Header.OpCode,
 			RecursionDesired: msg.Header.RecursionDesired,
 			RCode:            rcode,
 		},
@@ -6,6 +6,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestServer(t *testing.T) {
@@ -32,6 +34,40 @@ func TestStreamServer(t *testing.T) {
 	t.Log("response:", rmsg)
 }
 
+func TestPipeline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(l, nil)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ids := map[uint16]bool{1: true, 2: true, 3: true}
+	for id := range ids {
+		qmsg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: id},
+			Questions: []dnsmessage.Question{testq},
+		}
+		if err := sendMsg(qmsg, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for range []int{1, 2, 3} {
+		rmsg, err := receive(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ids[rmsg.Header.ID] {
+			t.Errorf("unexpected reply with id %d", rmsg.Header.ID)
+		}
+		delete(ids, rmsg.Header.ID)
+	}
+}
+
 func TestJunk(t *testing.T) {
 	addr := "127.0.0.1:5361"
 	go func() {
@@ -0,0 +1,328 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Types of the resources used for public key transaction signatures.
+const (
+	TypeSIG dnsmessage.Type = 24
+	TypeKEY dnsmessage.Type = 25
+)
+
+// DNSSEC algorithm numbers supported for SIG(0).
+const (
+	AlgECDSAP256SHA256 uint8 = 13 // RFC 6605
+	AlgECDSAP384SHA384 uint8 = 14 // RFC 6605
+	AlgED25519         uint8 = 15 // RFC 8080
+)
+
+// sig0Validity is how long either side of the current time a SIG(0)
+// signature is valid, allowing for clock skew.
+const sig0Validity = 5 * time.Minute
+
+var errSIG0 = errors.New("SIG(0) verification failed")
+
+// A PrivateKey signs messages with public key transaction signatures,
+// SIG(0) (RFC 2931). Name is the name of the KEY record holding the
+// public key in the zone of the server verifying the signature.
+// Signer must be an ed25519.PrivateKey or *ecdsa.PrivateKey using
+// the P-256 or P-384 curve.
+type PrivateKey struct {
+	Name   dnsmessage.Name
+	Signer crypto.Signer
+}
+
+func (k *PrivateKey) algorithm() (uint8, error) {
+	switch priv := k.Signer.(type) {
+	case ed25519.PrivateKey:
+		return AlgED25519, nil
+	case *ecdsa.PrivateKey:
+		switch priv.Curve {
+		case elliptic.P256():
+			return AlgECDSAP256SHA256, nil
+		case elliptic.P384():
+			return AlgECDSAP384SHA384, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported key type %T", k.Signer)
+}
+
+// KEYResource returns the KEY record holding the public key of k,
+// to be published in the zone at k.Name.
+func (k *PrivateKey) KEYResource(ttl uint32) (dnsmessage.Resource, error) {
+	rdata, err := k.keyData()
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: k.Name, Type: TypeKEY, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.UnknownResource{Type: TypeKEY, Data: rdata},
+	}, nil
+}
+
+// keyData returns the data of the KEY record of k.
+func (k *PrivateKey) keyData() ([]byte, error) {
+	alg, err := k.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	var pub []byte
+	switch priv := k.Signer.(type) {
+	case ed25519.PrivateKey:
+		pub = priv.Public().(ed25519.PublicKey)
+	case *ecdsa.PrivateKey:
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		pub = make([]byte, 2*size)
+		priv.X.FillBytes(pub[:size])
+		priv.Y.FillBytes(pub[size:])
+	}
+	// Flags 0x0200 marks a key associated with a host or user rather
+	// than a zone (RFC 2535 section 3.1.2). Protocol is always 3.
+	rdata := []byte{0x02, 0x00, 3, alg}
+	return append(rdata, pub...), nil
+}
+
+// Sign packs msg and appends a SIG(0) record signed by k.
+func (k *PrivateKey) Sign(msg dnsmessage.Message) ([]byte, error) {
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return k.sign(b)
+}
+
+func (k *PrivateKey) sign(b []byte) ([]byte, error) {
+	alg, err := k.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.keyData()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sig := sigRecord{
+		algorithm:  alg,
+		expiration: uint32(now.Add(sig0Validity).Unix()),
+		inception:  uint32(now.Add(-sig0Validity).Unix()),
+		keyTag:     keyTag(key),
+		signer:     k.Name,
+	}
+	data := append(sig.header(), b...)
+	switch priv := k.Signer.(type) {
+	case ed25519.PrivateKey:
+		sig.signature = ed25519.Sign(priv, data)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, sig0Hash(alg, data))
+		if err != nil {
+			return nil, err
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig.signature = make([]byte, 2*size)
+		r.FillBytes(sig.signature[:size])
+		s.FillBytes(sig.signature[size:])
+	}
+	return sig.appendTo(b), nil
+}
+
+func sig0Hash(alg uint8, data []byte) []byte {
+	if alg == AlgECDSAP384SHA384 {
+		sum := sha512.Sum384(data)
+		return sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// sigRecord holds the data of a SIG(0) resource. The type covered,
+// labels and original TTL fields are always zero.
+type sigRecord struct {
+	algorithm  uint8
+	expiration uint32
+	inception  uint32
+	keyTag     uint16
+	signer     dnsmessage.Name
+	signature  []byte
+}
+
+// header returns the record's data preceding the signature,
+// which is included in the signed data.
+func (s *sigRecord) header() []byte {
+	b := []byte{0, 0, s.algorithm, 0, 0, 0, 0, 0}
+	b = appendUint32(b, s.expiration)
+	b = appendUint32(b, s.inception)
+	b = appendUint16(b, s.keyTag)
+	return appendName(b, s.signer)
+}
+
+// appendTo appends the SIG(0) record to the message b, incrementing
+// the message's count of additional records.
+func (s *sigRecord) appendTo(b []byte) []byte {
+	rdata := append(s.header(), s.signature...)
+	b = append(b, 0) // root name
+	b = appendUint16(b, uint16(TypeSIG))
+	b = appendUint16(b, uint16(dnsmessage.ClassANY))
+	b = appendUint32(b, 0) // TTL
+	b = appendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
+
+func parseSIG(rdata []byte) (sigRecord, error) {
+	var s sigRecord
+	if len(rdata) < 18 {
+		return s, errors.New("short SIG record")
+	}
+	if binary.BigEndian.Uint16(rdata) != 0 {
+		return s, errors.New("SIG record covers a type: not SIG(0)")
+	}
+	s.algorithm = rdata[2]
+	s.expiration = binary.BigEndian.Uint32(rdata[8:])
+	s.inception = binary.BigEndian.Uint32(rdata[12:])
+	s.keyTag = binary.BigEndian.Uint16(rdata[16:])
+	signer, off, err := ReadName(rdata, 18)
+	if err != nil {
+		return s, fmt.Errorf("signer name: %w", err)
+	}
+	s.signer = signer
+	s.signature = rdata[off:]
+	return s, nil
+}
+
+// isSIG0 reports whether r is a SIG(0) record.
+func isSIG0(r dnsmessage.Resource) bool {
+	return r.Header.Type == TypeSIG && r.Header.Class == dnsmessage.ClassANY
+}
+
+// verifySIG0 checks the SIG(0) record at the end of the message b
+// against the KEY records returned by keys for the signer's name.
+// The name of the signer is returned.
+func verifySIG0(b []byte, keys func(dnsmessage.Name) []dnsmessage.Resource) (dnsmessage.Name, error) {
+	msg, err := unpack(b)
+	if err != nil {
+		return dnsmessage.Name{}, err
+	}
+	n := len(msg.Additionals)
+	if n == 0 || !isSIG0(msg.Additionals[n-1]) {
+		return dnsmessage.Name{}, errUnsigned
+	}
+	body, ok := msg.Additionals[n-1].Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return dnsmessage.Name{}, errSIG0
+	}
+	sig, err := parseSIG(body.Data)
+	if err != nil {
+		return dnsmessage.Name{}, err
+	}
+	now := uint32(time.Now().Unix())
+	if serialLess(now, sig.inception) || serialLess(sig.expiration, now) {
+		return sig.signer, fmt.Errorf("%w: signature expired or not yet valid", errSIG0)
+	}
+	off, err := lastRecordOffset(b)
+	if err != nil {
+		return sig.signer, err
+	}
+	signed := make([]byte, off)
+	copy(signed, b[:off])
+	binary.BigEndian.PutUint16(signed[10:], uint16(n-1))
+	data := append(sig.header(), signed...)
+
+	for _, r := range keys(sig.signer) {
+		key, ok := r.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(key.Data) < 4 || key.Data[3] != sig.algorithm || keyTag(key.Data) != sig.keyTag {
+			continue
+		}
+		if verifySignature(sig.algorithm, key.Data[4:], data, sig.signature) {
+			return sig.signer, nil
+		}
+	}
+	return sig.signer, errSIG0
+}
+
+func verifySignature(alg uint8, pub, data, sig []byte) bool {
+	switch alg {
+	case AlgED25519:
+		return len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, data, sig)
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve := elliptic.P256()
+		if alg == AlgECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(pub) != 2*size || len(sig) != 2*size {
+			return false
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pub[:size]),
+			Y:     new(big.Int).SetBytes(pub[size:]),
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, sig0Hash(alg, data), r, s)
+	}
+	return false
+}
+
+// exchangeSIG0 is like exchangeKey but signs msg with k using SIG(0).
+// Replies are not signed.
+func exchangeSIG0(msg dnsmessage.Message, network, addr string, k *PrivateKey, timeout time.Duration) (dnsmessage.Message, error) {
+	b, err := k.Sign(msg)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	if _, err := send(b, conn); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	b, err = receiveBytes(conn)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	rmsg, err := unpack(b)
+	if err != nil {
+		return rmsg, err
+	}
+	if rmsg.Header.ID != msg.Header.ID {
+		return rmsg, errMismatchedID
+	}
+	return rmsg, nil
+}
+
+// keyTag returns the key tag of the KEY record data rdata
+// as described in RFC 4034 appendix B.
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
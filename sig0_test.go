@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSIG0Update(t *testing.T) {
+	_, edkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*PrivateKey{
+		{Name: dnsmessage.MustNewName("ed25519.example.test."), Signer: edkey},
+		{Name: dnsmessage.MustNewName("ecdsa.example.test."), Signer: eckey},
+	}
+
+	z := testZone()
+	for _, k := range keys {
+		rr, err := k.KEYResource(3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.Resources = append(z.Resources, rr)
+		z.AllowUpdate = append(z.AllowUpdate, UpdatePolicy{Key: k.Name.String(), Name: k.Name})
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{z}}
+	go srv.ServePacket(conn)
+	addr := conn.LocalAddr().String()
+
+	for _, k := range keys {
+		u := &Update{Zone: z.Name, PrivateKey: k}
+		u.Add(testA(k.Name.String(), 192, 0, 2, 40))
+		if err := SendUpdate(u, addr); err != nil {
+			t.Errorf("update signed by %s: %v", k.Name, err)
+		}
+		// each key may only change its own name.
+		u = &Update{Zone: z.Name, PrivateKey: k}
+		u.Add(testA("www.example.test.", 192, 0, 2, 41))
+		if err := SendUpdate(u, addr); !errors.Is(err, ErrRefused) {
+			t.Errorf("update of other name signed by %s: got %v, want %v", k.Name, err, ErrRefused)
+		}
+	}
+
+	// a key whose public key is not in the zone.
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Update{Zone: z.Name, PrivateKey: &PrivateKey{Name: keys[0].Name, Signer: other}}
+	u.Add(testA(keys[0].Name.String(), 192, 0, 2, 42))
+	if err := SendUpdate(u, addr); !errors.Is(err, ErrNotAuth) {
+		t.Errorf("update signed by unknown key: got %v, want %v", err, ErrNotAuth)
+	}
+	if z.Serial() != 3 {
+		t.Errorf("zone serial %d, want 3", z.Serial())
+	}
+}
+
+func TestSIG0Tampered(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &PrivateKey{Name: dnsmessage.MustNewName("host.example.test."), Signer: priv}
+	rr, err := k.KEYResource(3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func(dnsmessage.Name) []dnsmessage.Resource { return []dnsmessage.Resource{rr} }
+
+	u := &Update{Zone: dnsmessage.MustNewName("example.test.")}
+	u.Add(testA("host.example.test.", 192, 0, 2, 1))
+	b, err := k.Sign(u.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := verifySIG0(b, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.String() != k.Name.String() {
+		t.Errorf("signer %s, want %s", signer, k.Name)
+	}
+	b[13] = 'x'
+	if _, err := verifySIG0(b, keys); err == nil {
+		t.Error("tampered message verified")
+	}
+}
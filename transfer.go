@@ -0,0 +1,323 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TypeIXFR is the query type of an incremental zone transfer (RFC 1995).
+const TypeIXFR dnsmessage.Type = 251
+
+// transferSize is the greatest number of resources sent in each
+// message of a zone transfer.
+const transferSize = 100
+
+// transfer answers a zone transfer request for z.
+// Transfers are only permitted over stream connections from clients
+// in the server's AllowTransfer networks.
+func (srv *Server) transfer(w *response, msg *dnsmessage.Message, z *Zone) {
+	if w.pconn != nil || !containsIP(srv.AllowTransfer, addrIP(w.RemoteAddr())) {
+		Refuse(w, msg)
+		return
+	}
+	z.mu.RLock()
+	if z.expired {
+		z.mu.RUnlock()
+		ServerFailure(w, msg)
+		return
+	}
+	rrs := axfrRecords(z)
+	if msg.Questions[0].Type == TypeIXFR {
+		serial, ok := requestSerial(msg)
+		if !ok {
+			z.mu.RUnlock()
+			FormatError(w, msg)
+			return
+		}
+		if !serialLess(serial, z.SOA.Serial) {
+			rrs = []dnsmessage.Resource{z.soaResource()}
+		} else if changes, ok := z.changesSince(serial); ok {
+			rrs = ixfrRecords(z, changes)
+		}
+		// otherwise fall back to sending the whole zone, as
+		// permitted by RFC 1995 section 4.
+	}
+	z.mu.RUnlock()
+	writeTransfer(w, msg, rrs)
+}
+
+// requestSerial returns the serial of the SOA record sent by the client
+// in the authority section of an IXFR request.
+func requestSerial(msg *dnsmessage.Message) (uint32, bool) {
+	for _, r := range msg.Authorities {
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// axfrRecords returns every record in z bracketed by the zone's SOA
+// record, as sent in a full zone transfer (RFC 5936).
+func axfrRecords(z *Zone) []dnsmessage.Resource {
+	rrs := make([]dnsmessage.Resource, 0, len(z.Resources)+2)
+	rrs = append(rrs, z.soaResource())
+	rrs = append(rrs, z.Resources...)
+	return append(rrs, z.soaResource())
+}
+
+// ixfrRecords returns the sequence of differences described in
+// RFC 1995 section 4 which bring a client up to date with z.
+func ixfrRecords(z *Zone, changes []change) []dnsmessage.Resource {
+	rrs := []dnsmessage.Resource{z.soaResource()}
+	for _, c := range changes {
+		rrs = append(rrs, soaRecord(z.Name, c.from))
+		rrs = append(rrs, c.deleted...)
+		rrs = append(rrs, soaRecord(z.Name, c.to))
+		rrs = append(rrs, c.added...)
+	}
+	return append(rrs, z.soaResource())
+}
+
+// writeTransfer streams rrs to w as the answers of one or more
+// messages replying to msg.
+func writeTransfer(w ResponseWriter, msg *dnsmessage.Message, rrs []dnsmessage.Resource) error {
+	questions := msg.Questions
+	for len(rrs) > 0 {
+		n := transferSize
+		if n > len(rrs) {
+			n = len(rrs)
+		}
+		rmsg := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:            msg.Header.ID,
+				Response:      true,
+				Authoritative: true,
+			},
+			Questions: questions,
+			Answers:   rrs[:n],
+		}
+		// shrink the message until it fits.
+		for n > 1 && tooBig(rmsg) {
+			n /= 2
+			rmsg.Answers = rrs[:n]
+		}
+		if err := w.WriteMsg(rmsg); err != nil {
+			return err
+		}
+		rrs = rrs[n:]
+		// only the first message needs to repeat the question.
+		questions = nil
+	}
+	return nil
+}
+
+func tooBig(msg dnsmessage.Message) bool {
+	b, err := msg.Pack()
+	return err == nil && len(b) > MaxMsgSize
+}
+
+// addrIP returns the IP address of addr, or nil if addr has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transferTimeout is the longest time to wait for each message
+// of an incoming zone transfer.
+const transferTimeout = 30 * time.Second
+
+var errTransferEnded = errors.New("transfer ended before closing SOA record")
+
+// AXFR requests a full transfer of the zone name from the server at addr.
+func AXFR(name dnsmessage.Name, addr string) (*Zone, error) {
+	z := &Zone{Name: name}
+	if err := z.axfr(addr, nil); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// axfr replaces the contents of z with a full zone transfer from addr,
+// signed with k if not nil.
+func (z *Zone) axfr(addr string, k *Key) error {
+	q := dnsmessage.Question{Name: z.Name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: newID()},
+		Questions: []dnsmessage.Question{q},
+	}
+	rrs, err := transferIn(qmsg, addr, k)
+	if err != nil {
+		return err
+	}
+	return z.load(rrs)
+}
+
+// load replaces the contents of the zone with the records of a full zone transfer.
+func (z *Zone) load(rrs []dnsmessage.Resource) error {
+	if len(rrs) < 2 {
+		return errTransferEnded
+	}
+	soa, ok := rrs[0].Body.(*dnsmessage.SOAResource)
+	if !ok {
+		return fmt.Errorf("transfer starts with %s record, not SOA", rrs[0].Header.Type)
+	}
+	resources := make([]dnsmessage.Resource, len(rrs)-2)
+	copy(resources, rrs[1:len(rrs)-1])
+	z.replace(*soa, resources)
+	return nil
+}
+
+// ixfr brings z up to date with the server at addr with an incremental
+// zone transfer, signed with k if not nil. The server may instead reply with the whole zone,
+// in which case the zone's contents are replaced.
+func (z *Zone) ixfr(addr string, k *Key) error {
+	q := dnsmessage.Question{Name: z.Name, Type: TypeIXFR, Class: dnsmessage.ClassINET}
+	z.mu.RLock()
+	qmsg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: newID()},
+		Questions:   []dnsmessage.Question{q},
+		Authorities: []dnsmessage.Resource{z.soaResource()},
+	}
+	z.mu.RUnlock()
+	rrs, err := transferIn(qmsg, addr, k)
+	if err != nil {
+		return err
+	}
+	if len(rrs) == 1 {
+		return nil // already up to date
+	}
+	if rrs[1].Header.Type != dnsmessage.TypeSOA {
+		return z.load(rrs)
+	}
+	// Apply each difference in turn: the old SOA record and
+	// deletions, then the new SOA record and additions.
+	rrs = rrs[1 : len(rrs)-1]
+	for len(rrs) > 0 {
+		var deleted, added []dnsmessage.Resource
+		i := 1
+		for i < len(rrs) && rrs[i].Header.Type != dnsmessage.TypeSOA {
+			deleted = append(deleted, rrs[i])
+			i++
+		}
+		if i == len(rrs) {
+			return errTransferEnded
+		}
+		soa := rrs[i].Body.(*dnsmessage.SOAResource)
+		i++
+		for i < len(rrs) && rrs[i].Header.Type != dnsmessage.TypeSOA {
+			added = append(added, rrs[i])
+			i++
+		}
+		z.Change(*soa, deleted, added)
+		rrs = rrs[i:]
+	}
+	return nil
+}
+
+// transferIn sends the zone transfer request qmsg to addr over TCP
+// and returns every record received, including the bracketing SOA records.
+// If k is not nil, the request is signed with k and each reply must be
+// signed by the same key.
+func transferIn(qmsg dnsmessage.Message, addr string, k *Key) ([]dnsmessage.Resource, error) {
+	conn, err := net.DialTimeout("tcp", addr, transferTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var tsig *tsigState
+	if k != nil {
+		tsig, err = sendSigned(qmsg, conn, k)
+	} else {
+		err = sendMsg(qmsg, conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// unsigned holds messages received since the last signed message.
+	var unsigned []byte
+	var rrs []dnsmessage.Resource
+	var serial uint32
+	var soas int
+	incremental := false
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(transferTimeout)); err != nil {
+			return nil, err
+		}
+		b, err := receiveBytes(conn)
+		if err != nil {
+			return nil, err
+		}
+		var rmsg dnsmessage.Message
+		if tsig != nil {
+			rmsg, err = tsig.verify(b, &unsigned)
+		} else {
+			rmsg, err = unpack(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rmsg.Header.ID != qmsg.Header.ID {
+			return nil, errMismatchedID
+		} else if rmsg.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("transfer %s: %s", qmsg.Questions[0].Name, rmsg.Header.RCode)
+		}
+		for _, r := range rmsg.Answers {
+			if len(rrs) == 0 {
+				soa, ok := r.Body.(*dnsmessage.SOAResource)
+				if !ok {
+					return nil, fmt.Errorf("transfer starts with %s record, not SOA", r.Header.Type)
+				}
+				serial = soa.Serial
+			} else if soa, ok := r.Body.(*dnsmessage.SOAResource); ok && len(rrs) == 1 {
+				incremental = soa.Serial != serial
+			}
+			rrs = append(rrs, r)
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok && soa.Serial == serial {
+				soas++
+			}
+		}
+		// A single SOA record in reply to an IXFR request means
+		// the client is up to date.
+		if len(rrs) == 1 && qmsg.Questions[0].Type == TypeIXFR && len(unsigned) == 0 {
+			return rrs, nil
+		}
+		// The current SOA record appears at the start and end of
+		// the transfer, and once more in an incremental transfer
+		// to begin the last set of additions.
+		if (!incremental && soas == 2) || soas == 3 {
+			if len(unsigned) > 0 {
+				// RFC 8945 section 5.3.1: the last message must be signed.
+				return nil, errUnsigned
+			}
+			return rrs, nil
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testZone() *Zone {
+	name := dnsmessage.MustNewName("example.test.")
+	return &Zone{
+		Name: name,
+		SOA: dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns1.example.test."),
+			MBox:    dnsmessage.MustNewName("hostmaster.example.test."),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  300,
+		},
+		Resources: []dnsmessage.Resource{
+			testA("www.example.test.", 192, 0, 2, 1),
+			testA("mail.example.test.", 192, 0, 2, 2),
+		},
+	}
+}
+
+func testA(name string, a, b, c, d byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.AResource{A: [4]byte{a, b, c, d}},
+	}
+}
+
+// serveTestZone serves z over TCP to loopback clients and returns the
+// address of the listener.
+func serveTestZone(t *testing.T, z *Zone) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := &Server{Zones: []*Zone{z}, AllowTransfer: []*net.IPNet{loopback}}
+	go srv.Serve(l)
+	return l.Addr().String()
+}
+
+func TestAXFR(t *testing.T) {
+	z := testZone()
+	addr := serveTestZone(t, z)
+	q := dnsmessage.Question{Name: z.Name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{Header: dnsmessage.Header{ID: 1}, Questions: []dnsmessage.Question{q}}
+	rrs, err := transferIn(qmsg, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != len(z.Resources)+2 {
+		t.Errorf("got %d records, want %d", len(rrs), len(z.Resources)+2)
+	}
+
+	// transfers must be refused over UDP.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{z}}
+	go srv.ServePacket(conn)
+	rmsg, err := Exchange(qmsg, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rmsg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("transfer over UDP: got rcode %s, want %s", rmsg.Header.RCode, dnsmessage.RCodeRefused)
+	}
+}
+
+func TestLargeAXFR(t *testing.T) {
+	z := testZone()
+	for i := 0; i < 1000; i++ {
+		z.Resources = append(z.Resources, testA("www.example.test.", 198, 51, byte(i>>8), byte(i)))
+	}
+	addr := serveTestZone(t, z)
+	q := dnsmessage.Question{Name: z.Name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{Header: dnsmessage.Header{ID: 2}, Questions: []dnsmessage.Question{q}}
+	rrs, err := transferIn(qmsg, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != len(z.Resources)+2 {
+		t.Errorf("got %d records, want %d", len(rrs), len(z.Resources)+2)
+	}
+}
+
+func TestIXFR(t *testing.T) {
+	z := testZone()
+	old := z.SOA
+	soa := z.SOA
+	soa.Serial++
+	z.Change(soa, z.Resources[:1], []dnsmessage.Resource{testA("www.example.test.", 192, 0, 2, 3)})
+	addr := serveTestZone(t, z)
+
+	q := dnsmessage.Question{Name: z.Name, Type: TypeIXFR, Class: dnsmessage.ClassINET}
+	qmsg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 3},
+		Questions:   []dnsmessage.Question{q},
+		Authorities: []dnsmessage.Resource{soaRecord(z.Name, old)},
+	}
+	rrs, err := transferIn(qmsg, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new SOA, old SOA, deleted, new SOA, added, new SOA
+	if len(rrs) != 6 {
+		t.Fatalf("got %d records, want 6: %v", len(rrs), rrs)
+	}
+	if !equalResource(rrs[2], testA("www.example.test.", 192, 0, 2, 1)) {
+		t.Errorf("unexpected deleted record %v", rrs[2])
+	}
+	if !equalResource(rrs[4], testA("www.example.test.", 192, 0, 2, 3)) {
+		t.Errorf("unexpected added record %v", rrs[4])
+	}
+
+	// up to date clients should just get the current SOA.
+	qmsg.Authorities = []dnsmessage.Resource{z.soaResource()}
+	rrs, err = transferIn(qmsg, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Errorf("got %d records, want 1", len(rrs))
+	}
+}
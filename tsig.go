@@ -0,0 +1,596 @@
+package dns
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TypeTSIG is the type of a transaction signature resource (RFC 8945).
+const TypeTSIG dnsmessage.Type = 250
+
+// Errors reported in TSIG records (RFC 8945 section 3).
+// They are sent with the response code RCodeNotAuth.
+const (
+	RCodeBadSig  dnsmessage.RCode = 16 // signature failure
+	RCodeBadKey  dnsmessage.RCode = 17 // key not recognised
+	RCodeBadTime dnsmessage.RCode = 18 // signature out of time window
+)
+
+var (
+	ErrBadSig  error = RCodeError(RCodeBadSig)
+	ErrBadKey  error = RCodeError(RCodeBadKey)
+	ErrBadTime error = RCodeError(RCodeBadTime)
+)
+
+var errUnsigned = errors.New("message not signed")
+
+// Names of the HMAC algorithms supported for TSIG.
+// HMAC-MD5 is provided for interoperability with older software only.
+var (
+	HMACMD5    = dnsmessage.MustNewName("hmac-md5.sig-alg.reg.int.")
+	HMACSHA256 = dnsmessage.MustNewName("hmac-sha256.")
+	HMACSHA384 = dnsmessage.MustNewName("hmac-sha384.")
+	HMACSHA512 = dnsmessage.MustNewName("hmac-sha512.")
+)
+
+var algorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int.": md5.New,
+	"hmac-sha256.":              sha256.New,
+	"hmac-sha384.":              sha512.New384,
+	"hmac-sha512.":              sha512.New,
+}
+
+// defaultFudge is the permitted difference in seconds between the time
+// a message was signed and the time it is verified.
+const defaultFudge = 300
+
+// A Key is a secret shared between a client and server to authenticate
+// messages with transaction signatures (TSIG).
+type Key struct {
+	Name      dnsmessage.Name
+	Algorithm dnsmessage.Name
+	Secret    []byte
+}
+
+func (k *Key) hash() (func() hash.Hash, error) {
+	h, ok := algorithms[strings.ToLower(k.Algorithm.String())]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Algorithm)
+	}
+	return h, nil
+}
+
+// A KeyRing holds keys indexed by their lower-case, fully qualified name.
+type KeyRing map[string]*Key
+
+// Add adds k to the ring, replacing any key with the same name.
+func (ring KeyRing) Add(k *Key) {
+	ring[ringIndex(k.Name)] = k
+}
+
+func (ring KeyRing) key(name dnsmessage.Name) (*Key, bool) {
+	k, ok := ring[ringIndex(name)]
+	return k, ok
+}
+
+// ringIndex returns the lower-case, fully qualified form of name.
+func ringIndex(name dnsmessage.Name) string {
+	s := strings.ToLower(name.String())
+	if !strings.HasSuffix(s, ".") {
+		s += "."
+	}
+	return s
+}
+
+// ReadKeyRing reads keys from r. Each line holds a key's name,
+// algorithm and base64-encoded secret separated by spaces, such as:
+//
+//	update.example.com. hmac-sha256 c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0Cg==
+//
+// Blank lines and lines beginning with "#" are ignored.
+func ReadKeyRing(r io.Reader) (KeyRing, error) {
+	ring := make(KeyRing)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("want name, algorithm and secret; got %d fields", len(fields))
+		}
+		if !strings.HasSuffix(fields[0], ".") {
+			fields[0] += "."
+		}
+		name, err := dnsmessage.NewName(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("key name %s: %w", fields[0], err)
+		}
+		alg := strings.ToLower(fields[1])
+		if alg == "hmac-md5" {
+			alg = HMACMD5.String()
+		}
+		if !strings.HasSuffix(alg, ".") {
+			alg += "."
+		}
+		if _, ok := algorithms[alg]; !ok {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %s", fields[0], fields[1])
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: decode secret: %w", fields[0], err)
+		}
+		ring.Add(&Key{Name: name, Algorithm: dnsmessage.MustNewName(alg), Secret: secret})
+	}
+	return ring, sc.Err()
+}
+
+// tsigRecord holds the data of a TSIG resource.
+type tsigRecord struct {
+	name       dnsmessage.Name // of the key
+	algorithm  dnsmessage.Name
+	timeSigned uint64 // 48 bit seconds since the Unix epoch
+	fudge      uint16
+	mac        []byte
+	originalID uint16
+	err        dnsmessage.RCode
+	other      []byte
+}
+
+// variables returns the TSIG variables included in a message digest.
+// Only the timers are included for the second and subsequent messages
+// of a multi-message response such as a zone transfer.
+func (t *tsigRecord) variables(timersOnly bool) []byte {
+	var b []byte
+	if !timersOnly {
+		b = appendName(b, t.name)
+		b = appendUint16(b, uint16(dnsmessage.ClassANY))
+		b = appendUint32(b, 0) // TTL
+		b = appendName(b, t.algorithm)
+	}
+	b = appendUint48(b, t.timeSigned)
+	b = appendUint16(b, t.fudge)
+	if !timersOnly {
+		b = appendUint16(b, uint16(t.err))
+		b = appendUint16(b, uint16(len(t.other)))
+		b = append(b, t.other...)
+	}
+	return b
+}
+
+// appendTo appends the TSIG record in wire format to the message b,
+// incrementing the message's count of additional records.
+func (t *tsigRecord) appendTo(b []byte) []byte {
+	var rdata []byte
+	rdata = appendName(rdata, t.algorithm)
+	rdata = appendUint48(rdata, t.timeSigned)
+	rdata = appendUint16(rdata, t.fudge)
+	rdata = appendUint16(rdata, uint16(len(t.mac)))
+	rdata = append(rdata, t.mac...)
+	rdata = appendUint16(rdata, t.originalID)
+	rdata = appendUint16(rdata, uint16(t.err))
+	rdata = appendUint16(rdata, uint16(len(t.other)))
+	rdata = append(rdata, t.other...)
+
+	b = appendName(b, t.name)
+	b = appendUint16(b, uint16(TypeTSIG))
+	b = appendUint16(b, uint16(dnsmessage.ClassANY))
+	b = appendUint32(b, 0) // TTL
+	b = appendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
+
+func parseTSIG(name dnsmessage.Name, rdata []byte) (tsigRecord, error) {
+	t := tsigRecord{name: name}
+	alg, off, err := ReadName(rdata, 0)
+	if err != nil {
+		return t, fmt.Errorf("algorithm name: %w", err)
+	}
+	t.algorithm = alg
+	if len(rdata) < off+10 {
+		return t, errTSIGLen
+	}
+	t.timeSigned = uint64(binary.BigEndian.Uint16(rdata[off:]))<<32 | uint64(binary.BigEndian.Uint32(rdata[off+2:]))
+	t.fudge = binary.BigEndian.Uint16(rdata[off+6:])
+	macLen := int(binary.BigEndian.Uint16(rdata[off+8:]))
+	off += 10
+	if len(rdata) < off+macLen+6 {
+		return t, errTSIGLen
+	}
+	t.mac = rdata[off : off+macLen]
+	off += macLen
+	t.originalID = binary.BigEndian.Uint16(rdata[off:])
+	t.err = dnsmessage.RCode(binary.BigEndian.Uint16(rdata[off+2:]))
+	otherLen := int(binary.BigEndian.Uint16(rdata[off+4:]))
+	off += 6
+	if len(rdata) < off+otherLen {
+		return t, errTSIGLen
+	}
+	t.other = rdata[off : off+otherLen]
+	return t, nil
+}
+
+var errTSIGLen = errors.New("short TSIG record")
+
+// digest returns the message authentication code of the TSIG variables
+// of t and msg, the message without its TSIG record. The MAC of a
+// request is prior when signing or verifying its response. For
+// the second and subsequent messages of a response, prior is the
+// MAC of the previous signed message and only the timers of t are
+// included in the digest.
+func (t *tsigRecord) digest(k *Key, msg, prior []byte, timersOnly bool) ([]byte, error) {
+	h, err := k.hash()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(h, k.Secret)
+	if len(prior) > 0 {
+		mac.Write(appendUint16(nil, uint16(len(prior))))
+		mac.Write(prior)
+	}
+	mac.Write(msg)
+	mac.Write(t.variables(timersOnly))
+	return mac.Sum(nil), nil
+}
+
+// signTSIG appends a TSIG record signed by k to the packed message b,
+// returning the signed message and its MAC.
+func signTSIG(b []byte, k *Key, prior []byte, timersOnly bool) ([]byte, []byte, error) {
+	if len(b) < 12 {
+		return nil, nil, errors.New("short message")
+	}
+	t := tsigRecord{
+		name:       k.Name,
+		algorithm:  k.Algorithm,
+		timeSigned: uint64(time.Now().Unix()),
+		fudge:      defaultFudge,
+		originalID: binary.BigEndian.Uint16(b),
+	}
+	mac, err := t.digest(k, b, prior, timersOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.mac = mac
+	return t.appendTo(b), mac, nil
+}
+
+// splitTSIG separates the TSIG record from the end of the message b.
+// The message is returned as it was before signing: without the TSIG
+// record and with its original ID. errUnsigned is returned if there
+// is no TSIG record.
+func splitTSIG(b []byte) ([]byte, tsigRecord, error) {
+	msg, err := unpack(b)
+	if err != nil {
+		return nil, tsigRecord{}, err
+	}
+	n := len(msg.Additionals)
+	if n == 0 || msg.Additionals[n-1].Header.Type != TypeTSIG {
+		return nil, tsigRecord{}, errUnsigned
+	}
+	off, err := lastRecordOffset(b)
+	if err != nil {
+		return nil, tsigRecord{}, err
+	}
+	r := msg.Additionals[n-1]
+	body, ok := r.Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return nil, tsigRecord{}, errTSIGLen
+	}
+	t, err := parseTSIG(r.Header.Name, body.Data)
+	if err != nil {
+		return nil, t, err
+	}
+	stripped := make([]byte, off)
+	copy(stripped, b[:off])
+	binary.BigEndian.PutUint16(stripped, t.originalID)
+	binary.BigEndian.PutUint16(stripped[10:], uint16(n-1))
+	return stripped, t, nil
+}
+
+// verifyTSIG checks the TSIG record of message b against the keys in ring.
+// The message without its TSIG record and the record itself are returned.
+// See tsigRecord.digest for a description of prior and timersOnly.
+func verifyTSIG(b []byte, ring KeyRing, prior []byte, timersOnly bool) ([]byte, tsigRecord, *Key, error) {
+	return verifyTSIGAfter(b, nil, ring, prior, timersOnly)
+}
+
+// verifyTSIGAfter is like verifyTSIG, but the MAC of b also covers the
+// unsigned messages preceding it in a multi-message response.
+func verifyTSIGAfter(b, unsigned []byte, ring KeyRing, prior []byte, timersOnly bool) ([]byte, tsigRecord, *Key, error) {
+	stripped, t, err := splitTSIG(b)
+	if err != nil {
+		return nil, t, nil, err
+	}
+	k, ok := ring.key(t.name)
+	if !ok || !equalName(k.Algorithm, t.algorithm) {
+		return stripped, t, nil, ErrBadKey
+	}
+	if t.err != dnsmessage.RCodeSuccess {
+		// Errors are reported unsigned, except for BADTIME.
+		if t.err != RCodeBadTime {
+			return stripped, t, k, RCodeError(t.err)
+		}
+	}
+	data := stripped
+	if len(unsigned) > 0 {
+		data = append(append([]byte(nil), unsigned...), stripped...)
+	}
+	mac, err := t.digest(k, data, prior, timersOnly)
+	if err != nil {
+		return stripped, t, k, err
+	}
+	if !hmac.Equal(mac, t.mac) {
+		return stripped, t, k, ErrBadSig
+	}
+	if t.err != dnsmessage.RCodeSuccess {
+		return stripped, t, k, RCodeError(t.err)
+	}
+	now := uint64(time.Now().Unix())
+	if now > t.timeSigned+uint64(t.fudge) || t.timeSigned > now+uint64(t.fudge) {
+		return stripped, t, k, ErrBadTime
+	}
+	return stripped, t, k, nil
+}
+
+// Sign packs msg and appends a TSIG record signed by k.
+func (k *Key) Sign(msg dnsmessage.Message) ([]byte, error) {
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	signed, _, err := signTSIG(b, k, nil, false)
+	return signed, err
+}
+
+// Verify checks the TSIG record at the end of the message b against
+// the keys in the ring, returning the key which signed the message.
+// ErrBadKey, ErrBadSig or ErrBadTime is returned if the message does
+// not verify.
+func (ring KeyRing) Verify(b []byte) (*Key, error) {
+	_, _, k, err := verifyTSIG(b, ring, nil, false)
+	return k, err
+}
+
+// tsigState holds the state of a signed exchange.
+type tsigState struct {
+	key *Key
+	// mac is the MAC of the last message signed or verified.
+	mac []byte
+	// continued is set after the first message of a response.
+	continued bool
+	// err is the TSIG error to report in the response, if any.
+	err dnsmessage.RCode
+}
+
+// sign signs the message b as the next message in the exchange.
+func (s *tsigState) sign(b []byte) ([]byte, error) {
+	if s.err == RCodeBadKey || s.err == RCodeBadSig {
+		// RFC 8945 section 5.3.2: reply with an empty MAC.
+		t := tsigRecord{
+			name:       s.key.Name,
+			algorithm:  s.key.Algorithm,
+			timeSigned: uint64(time.Now().Unix()),
+			fudge:      defaultFudge,
+			originalID: binary.BigEndian.Uint16(b),
+			err:        s.err,
+		}
+		return t.appendTo(b), nil
+	}
+	if s.err == RCodeBadTime {
+		t := tsigRecord{
+			name:       s.key.Name,
+			algorithm:  s.key.Algorithm,
+			timeSigned: uint64(time.Now().Unix()),
+			fudge:      defaultFudge,
+			originalID: binary.BigEndian.Uint16(b),
+			err:        s.err,
+			other:      appendUint48(nil, uint64(time.Now().Unix())),
+		}
+		mac, err := t.digest(s.key, b, s.mac, false)
+		if err != nil {
+			return nil, err
+		}
+		t.mac = mac
+		return t.appendTo(b), nil
+	}
+	signed, mac, err := signTSIG(b, s.key, s.mac, s.continued)
+	if err != nil {
+		return nil, err
+	}
+	s.mac = mac
+	s.continued = true
+	return signed, nil
+}
+
+// verify verifies the message b as the next message in the exchange.
+// Messages after the first may be unsigned, in which case they are
+// included in the digest of the next signed message. The unpacked
+// message is returned without its TSIG record.
+func (s *tsigState) verify(b []byte, unsigned *[]byte) (dnsmessage.Message, error) {
+	ring := KeyRing{}
+	ring.Add(s.key)
+	// the digest covers any unsigned messages since the last signed
+	// one (RFC 8945 section 5.3.1).
+	stripped, t, _, err := verifyTSIGAfter(b, *unsigned, ring, s.mac, s.continued)
+	if err == errUnsigned && s.continued {
+		*unsigned = append(*unsigned, b...)
+		return unpack(b)
+	} else if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	*unsigned = nil
+	s.mac = t.mac
+	s.continued = true
+	return unpack(stripped)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendName appends name to b in canonical (lower case, uncompressed) wire format.
+func appendName(b []byte, name dnsmessage.Name) []byte {
+	s := strings.ToLower(name.String())
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// ReadName reads an uncompressed name in wire format from b starting
+// at off, returning the name and the offset following it. It reads the
+// names held in the data of records unknown to dnsmessage, such as
+// DNAME (RFC 6672).
+func ReadName(b []byte, off int) (dnsmessage.Name, int, error) {
+	var labels []string
+	for {
+		if off >= len(b) {
+			return dnsmessage.Name{}, off, errors.New("name overflows buffer")
+		}
+		l := int(b[off])
+		off++
+		if l == 0 {
+			break
+		} else if l > 63 {
+			return dnsmessage.Name{}, off, errors.New("compressed or invalid label")
+		} else if off+l > len(b) {
+			return dnsmessage.Name{}, off, errors.New("label overflows buffer")
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+	name, err := dnsmessage.NewName(strings.Join(labels, ".") + ".")
+	return name, off, err
+}
+
+// lastRecordOffset returns the offset of the last resource record in
+// the message b.
+func lastRecordOffset(b []byte) (int, error) {
+	if len(b) < 12 {
+		return 0, errors.New("short message")
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	rrcount := 0
+	for i := 6; i < 12; i += 2 {
+		rrcount += int(binary.BigEndian.Uint16(b[i:]))
+	}
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipName(b, off); err != nil {
+			return 0, err
+		}
+		off += 4
+	}
+	last := off
+	for i := 0; i < rrcount; i++ {
+		last = off
+		if off, err = skipName(b, off); err != nil {
+			return 0, err
+		}
+		if off+10 > len(b) {
+			return 0, errors.New("short resource record")
+		}
+		off += 10 + int(binary.BigEndian.Uint16(b[off+8:]))
+	}
+	if off > len(b) {
+		return 0, errors.New("resource record overflows message")
+	}
+	return last, nil
+}
+
+// skipName returns the offset following the possibly compressed name at off.
+func skipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return off, errors.New("name overflows message")
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
+
+// exchangeKey is like exchangeTimeout, but if k is not nil the request
+// is signed with k and the reply must be signed by the same key.
+func exchangeKey(msg dnsmessage.Message, network, addr string, k *Key, timeout time.Duration) (dnsmessage.Message, error) {
+	if k == nil {
+		return exchangeTimeout(msg, network, addr, timeout)
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	state, err := sendSigned(msg, conn, k)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	b, err := receiveBytes(conn)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	rmsg, err := state.verify(b, new([]byte))
+	if err != nil {
+		return rmsg, err
+	}
+	if rmsg.Header.ID != msg.Header.ID {
+		return rmsg, errMismatchedID
+	}
+	return rmsg, nil
+}
+
+// sendSigned sends msg signed by k to conn, returning the state
+// with which to verify replies.
+func sendSigned(msg dnsmessage.Message, conn net.Conn, k *Key) (*tsigState, error) {
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	signed, mac, err := signTSIG(b, k, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := send(signed, conn); err != nil {
+		return nil, err
+	}
+	return &tsigState{key: k, mac: mac}, nil
+}
@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testKey = &Key{
+	Name:      dnsmessage.MustNewName("test-key."),
+	Algorithm: HMACSHA256,
+	Secret:    []byte("0123456789abcdef0123456789abcdef"),
+}
+
+func testRing(keys ...*Key) KeyRing {
+	ring := make(KeyRing)
+	for _, k := range keys {
+		ring.Add(k)
+	}
+	return ring
+}
+
+func TestSignVerify(t *testing.T) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234},
+		Questions: []dnsmessage.Question{testq},
+	}
+	for _, alg := range []dnsmessage.Name{HMACMD5, HMACSHA256, HMACSHA384, HMACSHA512} {
+		k := *testKey
+		k.Algorithm = alg
+		b, err := k.Sign(msg)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		got, err := testRing(&k).Verify(b)
+		if err != nil {
+			t.Errorf("%s: verify: %v", alg, err)
+		} else if got != &k {
+			t.Errorf("%s: verified by wrong key %v", alg, got.Name)
+		}
+	}
+
+	b, err := testKey.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRing().Verify(b); err != ErrBadKey {
+		t.Errorf("unknown key: got %v, want %v", err, ErrBadKey)
+	}
+	other := *testKey
+	other.Secret = []byte("wrong")
+	if _, err := testRing(&other).Verify(b); err != ErrBadSig {
+		t.Errorf("wrong secret: got %v, want %v", err, ErrBadSig)
+	}
+	b[13] = 'x' // www.example.com to wxw.example.com
+	if _, err := testRing(testKey).Verify(b); err != ErrBadSig {
+		t.Errorf("modified message: got %v, want %v", err, ErrBadSig)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := tsigRecord{
+		name:       testKey.Name,
+		algorithm:  testKey.Algorithm,
+		timeSigned: uint64(time.Now().Add(-time.Hour).Unix()),
+		fudge:      defaultFudge,
+		originalID: msg.Header.ID,
+	}
+	if old.mac, err = old.digest(testKey, packed, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRing(testKey).Verify(old.appendTo(packed)); err != ErrBadTime {
+		t.Errorf("old signature: got %v, want %v", err, ErrBadTime)
+	}
+}
+
+// TestSignEveryOther verifies a response from a primary which signs
+// only every other message, as permitted by RFC 8945 section 5.3.1.
+func TestSignEveryOther(t *testing.T) {
+	var msgs [][]byte
+	for i := 0; i < 5; i++ {
+		msg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1234, Response: true},
+			Questions: []dnsmessage.Question{testq},
+		}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, b)
+	}
+	var signed [][]byte
+	var prior, pending []byte
+	for i, b := range msgs {
+		if i%2 == 1 {
+			pending = append(pending, b...)
+			signed = append(signed, b)
+			continue
+		}
+		rec := tsigRecord{
+			name:       testKey.Name,
+			algorithm:  testKey.Algorithm,
+			timeSigned: uint64(time.Now().Unix()),
+			fudge:      defaultFudge,
+			originalID: 1234,
+		}
+		mac, err := rec.digest(testKey, append(pending, b...), prior, i > 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.mac = mac
+		signed = append(signed, rec.appendTo(append([]byte(nil), b...)))
+		prior, pending = mac, nil
+	}
+
+	state := &tsigState{key: testKey}
+	var unsigned []byte
+	for i, b := range signed {
+		if _, err := state.verify(b, &unsigned); err != nil {
+			t.Fatalf("verify message %d: %v", i, err)
+		}
+	}
+	if len(unsigned) > 0 {
+		t.Errorf("%d bytes of unsigned messages left after last signed message", len(unsigned))
+	}
+
+	tampered := append([]byte(nil), signed[1]...)
+	tampered[0] ^= 0xff
+	state = &tsigState{key: testKey}
+	unsigned = nil
+	for i, b := range [][]byte{signed[0], tampered, signed[2]} {
+		_, err := state.verify(b, &unsigned)
+		if i < 2 && err != nil {
+			t.Fatalf("verify message %d: %v", i, err)
+		} else if i == 2 && err != ErrBadSig {
+			t.Errorf("after modified unsigned message: got %v, want %v", err, ErrBadSig)
+		}
+	}
+}
+
+func TestReadKeyRing(t *testing.T) {
+	conf := `# keys for updates
+update.example.com. hmac-sha256 c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0Cg==
+
+legacy hmac-md5 c2VjcmV0Cg==
+`
+	ring, err := ReadKeyRing(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, ok := ring.key(dnsmessage.MustNewName("UPDATE.example.com."))
+	if !ok {
+		t.Fatal("update key not found")
+	}
+	if !equalName(k.Algorithm, HMACSHA256) {
+		t.Errorf("algorithm %s, want %s", k.Algorithm, HMACSHA256)
+	}
+	if k, ok := ring.key(dnsmessage.MustNewName("legacy.")); !ok || !equalName(k.Algorithm, HMACMD5) {
+		t.Errorf("legacy key missing or has wrong algorithm")
+	}
+
+	for _, bad := range []string{
+		"missing.secret. hmac-sha256",
+		"bad.alg. hmac-sha1 c2VjcmV0Cg==",
+		"bad.secret. hmac-sha256 !!!",
+	} {
+		if _, err := ReadKeyRing(strings.NewReader(bad)); err == nil {
+			t.Errorf("no error reading %q", bad)
+		}
+	}
+}
+
+func TestSignedUpdate(t *testing.T) {
+	z := testZone()
+	z.AllowUpdate = []UpdatePolicy{{Key: "test-key", Name: z.Name, Subdomains: true}}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{z}, Keys: testRing(testKey)}
+	go srv.ServePacket(conn)
+	addr := conn.LocalAddr().String()
+
+	u := &Update{Zone: z.Name, Key: testKey}
+	u.Add(testA("signed.example.test.", 192, 0, 2, 30))
+	if err := SendUpdate(u, addr); err != nil {
+		t.Errorf("signed update: %v", err)
+	}
+	u.Key = nil
+	if err := SendUpdate(u, addr); !errors.Is(err, ErrRefused) {
+		t.Errorf("unsigned update: got %v, want %v", err, ErrRefused)
+	}
+	wrong := *testKey
+	wrong.Secret = []byte("wrong")
+	u.Key = &wrong
+	if err := SendUpdate(u, addr); !errors.Is(err, ErrBadSig) {
+		t.Errorf("wrong secret: got %v, want %v", err, ErrBadSig)
+	}
+	unknown := *testKey
+	unknown.Name = dnsmessage.MustNewName("unknown-key.")
+	u.Key = &unknown
+	if err := SendUpdate(u, addr); !errors.Is(err, ErrBadKey) {
+		t.Errorf("unknown key: got %v, want %v", err, ErrBadKey)
+	}
+	if z.Serial() != 2 {
+		t.Errorf("zone serial %d, want 2", z.Serial())
+	}
+}
+
+func TestSignedTransfer(t *testing.T) {
+	z := testZone()
+	for i := 0; i < 500; i++ {
+		z.Resources = append(z.Resources, testA("www.example.test.", 198, 51, byte(i>>8), byte(i)))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := &Server{Zones: []*Zone{z}, AllowTransfer: []*net.IPNet{loopback}, Keys: testRing(testKey)}
+	go srv.Serve(l)
+
+	secondary := &Zone{Name: z.Name}
+	if err := secondary.axfr(l.Addr().String(), testKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(secondary.Resources) != len(z.Resources) {
+		t.Errorf("transferred %d resources, want %d", len(secondary.Resources), len(z.Resources))
+	}
+}
@@ -0,0 +1,514 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const OpCodeUPDATE dnsmessage.OpCode = 5 // RFC 2136
+
+// ClassNONE is used in dynamic updates to delete resource records
+// and in prerequisites that a name or RRset does not exist.
+const ClassNONE dnsmessage.Class = 254
+
+// Response codes from dynamic updates (RFC 2136 section 2.2).
+const (
+	RCodeYXDomain dnsmessage.RCode = 6  // name exists when it should not
+	RCodeYXRRSet  dnsmessage.RCode = 7  // RRset exists when it should not
+	RCodeNXRRSet  dnsmessage.RCode = 8  // RRset that should exist does not
+	RCodeNotAuth  dnsmessage.RCode = 9  // server not authoritative for zone
+	RCodeNotZone  dnsmessage.RCode = 10 // name not within zone
+)
+
+// RCodeError is returned when a server replies to a request
+// with an unsuccessful response code.
+type RCodeError dnsmessage.RCode
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeFormatError:    "format error",
+	dnsmessage.RCodeServerFailure:  "server failure",
+	dnsmessage.RCodeNameError:      "name error",
+	dnsmessage.RCodeNotImplemented: "not implemented",
+	dnsmessage.RCodeRefused:        "refused",
+	RCodeYXDomain:                  "name exists",
+	RCodeYXRRSet:                   "rrset exists",
+	RCodeNXRRSet:                   "rrset does not exist",
+	RCodeNotAuth:                   "not authoritative",
+	RCodeNotZone:                   "name not in zone",
+	RCodeBadSig:                    "bad signature",
+	RCodeBadKey:                    "bad key",
+	RCodeBadTime:                   "bad time",
+}
+
+func (e RCodeError) Error() string {
+	if s, ok := rcodeNames[dnsmessage.RCode(e)]; ok {
+		return s
+	}
+	return fmt.Sprintf("rcode %d", e)
+}
+
+// Errors returned by SendUpdate and SendUpdateTCP for the corresponding
+// response codes. Other response codes are returned as an RCodeError.
+var (
+	ErrRefused  error = RCodeError(dnsmessage.RCodeRefused)
+	ErrYXDomain error = RCodeError(RCodeYXDomain)
+	ErrYXRRSet  error = RCodeError(RCodeYXRRSet)
+	ErrNXDomain error = RCodeError(dnsmessage.RCodeNameError)
+	ErrNXRRSet  error = RCodeError(RCodeNXRRSet)
+	ErrNotAuth  error = RCodeError(RCodeNotAuth)
+	ErrNotZone  error = RCodeError(RCodeNotZone)
+)
+
+// An Update is a dynamic update (RFC 2136) of the records in Zone.
+// Records are only changed by the server if all Prerequisites are met.
+// Methods on Update append to Prerequisites and Updates.
+type Update struct {
+	Zone          dnsmessage.Name
+	Prerequisites []dnsmessage.Resource
+	Updates       []dnsmessage.Resource
+	// Key, if not nil, signs the update using TSIG.
+	Key *Key
+	// PrivateKey, if not nil, signs the update using SIG(0).
+	// It is ignored if Key is set.
+	PrivateKey *PrivateKey
+}
+
+// updateTimeout is the longest time to wait for a reply to an update.
+const updateTimeout = 10 * time.Second
+
+// emptyResource returns a resource with no data, as used in
+// prerequisites and deletions.
+func emptyResource(name dnsmessage.Name, t dnsmessage.Type, class dnsmessage.Class) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: t, Class: class},
+		Body:   &dnsmessage.UnknownResource{Type: t},
+	}
+}
+
+// NameInUse requires that at least one resource record with name exists.
+func (u *Update) NameInUse(name dnsmessage.Name) {
+	u.Prerequisites = append(u.Prerequisites, emptyResource(name, dnsmessage.TypeALL, dnsmessage.ClassANY))
+}
+
+// NameNotInUse requires that no resource records with name exist.
+func (u *Update) NameNotInUse(name dnsmessage.Name) {
+	u.Prerequisites = append(u.Prerequisites, emptyResource(name, dnsmessage.TypeALL, ClassNONE))
+}
+
+// RRsetExists requires that at least one resource record with
+// name and type t exists, regardless of its value.
+func (u *Update) RRsetExists(name dnsmessage.Name, t dnsmessage.Type) {
+	u.Prerequisites = append(u.Prerequisites, emptyResource(name, t, dnsmessage.ClassANY))
+}
+
+// RRsetNotExists requires that no resource records with name and type t exist.
+func (u *Update) RRsetNotExists(name dnsmessage.Name, t dnsmessage.Type) {
+	u.Prerequisites = append(u.Prerequisites, emptyResource(name, t, ClassNONE))
+}
+
+// RRsetExistsValue requires that the RRset of rrs exists and holds
+// exactly the values of rrs. All of rrs should have the same name and type.
+func (u *Update) RRsetExistsValue(rrs ...dnsmessage.Resource) {
+	for _, r := range rrs {
+		r.Header.TTL = 0
+		u.Prerequisites = append(u.Prerequisites, r)
+	}
+}
+
+// Add adds rrs to the zone.
+func (u *Update) Add(rrs ...dnsmessage.Resource) {
+	u.Updates = append(u.Updates, rrs...)
+}
+
+// Delete removes rrs from the zone.
+func (u *Update) Delete(rrs ...dnsmessage.Resource) {
+	for _, r := range rrs {
+		r.Header.Class = ClassNONE
+		r.Header.TTL = 0
+		u.Updates = append(u.Updates, r)
+	}
+}
+
+// DeleteRRset removes all resource records with name and type t from the zone.
+func (u *Update) DeleteRRset(name dnsmessage.Name, t dnsmessage.Type) {
+	u.Updates = append(u.Updates, emptyResource(name, t, dnsmessage.ClassANY))
+}
+
+// DeleteName removes all resource records with name from the zone.
+func (u *Update) DeleteName(name dnsmessage.Name) {
+	u.Updates = append(u.Updates, emptyResource(name, dnsmessage.TypeALL, dnsmessage.ClassANY))
+}
+
+// Message returns the update as a DNS message. The zone, prerequisite
+// and update sections are held in the questions, answers and
+// authorities of the message respectively.
+func (u *Update) Message() dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{ID: newID(), OpCode: OpCodeUPDATE},
+		Questions: []dnsmessage.Question{
+			{Name: u.Zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET},
+		},
+		Answers:     u.Prerequisites,
+		Authorities: u.Updates,
+	}
+}
+
+// SendUpdate sends u to the server at addr over UDP.
+// A nil error is returned if the update was applied.
+// If u.Key is set, the reply must be signed by the same key.
+// If the server rejects the update, an RCodeError is returned,
+// such as ErrNXRRSet if an RRset prerequisite was not met.
+func SendUpdate(u *Update, addr string) error {
+	return u.send("udp", addr)
+}
+
+// SendUpdateTCP is like SendUpdate but sends u over TCP.
+func SendUpdateTCP(u *Update, addr string) error {
+	return u.send("tcp", addr)
+}
+
+func (u *Update) send(network, addr string) error {
+	var rmsg dnsmessage.Message
+	var err error
+	if u.Key == nil && u.PrivateKey != nil {
+		rmsg, err = exchangeSIG0(u.Message(), network, addr, u.PrivateKey, updateTimeout)
+	} else {
+		rmsg, err = exchangeKey(u.Message(), network, addr, u.Key, updateTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return updateError(rmsg)
+}
+
+func updateError(rmsg dnsmessage.Message) error {
+	if rmsg.Header.OpCode != OpCodeUPDATE {
+		return fmt.Errorf("reply to update has opcode %d", rmsg.Header.OpCode)
+	}
+	if rmsg.Header.RCode != dnsmessage.RCodeSuccess {
+		return RCodeError(rmsg.Header.RCode)
+	}
+	return nil
+}
+
+// An UpdatePolicy permits changes to names in a zone by dynamic updates.
+type UpdatePolicy struct {
+	// Key is the name of the TSIG key, or of the KEY record in the zone
+	// for SIG(0), which must authenticate updates.
+	// If empty, unauthenticated updates are permitted; this should
+	// only be used on trusted networks.
+	Key string
+	// Name is the name which may be changed.
+	Name dnsmessage.Name
+	// Subdomains permits changes to any name below Name as well.
+	Subdomains bool
+	// Types lists the resource types which may be changed.
+	// If empty, resources of any type other than SOA may be changed.
+	Types []dnsmessage.Type
+}
+
+// permits reports whether the policy allows a client authenticated by
+// key to change the resources of type t with name.
+func (p UpdatePolicy) permits(key string, name dnsmessage.Name, t dnsmessage.Type) bool {
+	if p.Key != "" && !strings.EqualFold(strings.TrimSuffix(p.Key, "."), strings.TrimSuffix(key, ".")) {
+		return false
+	}
+	if p.Subdomains {
+		if !IsSubdomain(name, p.Name) {
+			return false
+		}
+	} else if !equalName(name, p.Name) {
+		return false
+	}
+	if len(p.Types) == 0 {
+		return t != dnsmessage.TypeSOA
+	}
+	for _, pt := range p.Types {
+		if pt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func permitted(policies []UpdatePolicy, key string, name dnsmessage.Name, t dnsmessage.Type) bool {
+	for _, p := range policies {
+		if p.permits(key, name, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies the dynamic update msg to z as described in
+// RFC 2136 section 3. The update is applied atomically: either all
+// changes are made or none are.
+func update(w *response, msg *dnsmessage.Message, z *Zone) {
+	rcode := applyUpdate(msg, z, w.key)
+	w.WriteMsg(dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       msg.Header.ID,
+			Response: true,
+			OpCode:   OpCodeUPDATE,
+			RCode:    rcode,
+		},
+		Questions: msg.Questions,
+	})
+}
+
+func applyUpdate(msg *dnsmessage.Message, z *Zone, key string) dnsmessage.RCode {
+	q := msg.Questions[0]
+	if q.Type != dnsmessage.TypeSOA {
+		return dnsmessage.RCodeFormatError
+	}
+	if !equalName(q.Name, z.Name) {
+		return RCodeNotAuth
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.secondary != nil || z.expired {
+		// we only hold a copy; updates must be made on the primary.
+		return dnsmessage.RCodeRefused
+	}
+	if rcode := z.checkPrerequisites(msg.Answers); rcode != dnsmessage.RCodeSuccess {
+		return rcode
+	}
+	if rcode := prescan(z, msg.Authorities); rcode != dnsmessage.RCodeSuccess {
+		return rcode
+	}
+	for _, r := range msg.Authorities {
+		if !permitted(z.AllowUpdate, key, r.Header.Name, r.Header.Type) {
+			return dnsmessage.RCodeRefused
+		}
+	}
+	updated := updateResources(z.Name, z.Resources, msg.Authorities)
+	deleted := difference(z.Resources, updated)
+	added := difference(updated, z.Resources)
+	soa, replaced := z.updatedSOA(msg.Authorities)
+	if len(deleted) == 0 && len(added) == 0 && !replaced {
+		return dnsmessage.RCodeSuccess
+	}
+	if !replaced {
+		soa.Serial++
+	}
+	z.change(soa, deleted, added)
+	return dnsmessage.RCodeSuccess
+}
+
+// updatedSOA returns the SOA record of z, replaced by the last SOA
+// record added by updates. As in RFC 2136 section 3.4.2.2, an added
+// SOA record is ignored unless its serial number is greater than the
+// zone's. The second result reports whether the record was replaced.
+// z.mu must be held.
+func (z *Zone) updatedSOA(updates []dnsmessage.Resource) (dnsmessage.SOAResource, bool) {
+	soa, replaced := z.SOA, false
+	for _, u := range updates {
+		b, ok := u.Body.(*dnsmessage.SOAResource)
+		if !ok || u.Header.Class != dnsmessage.ClassINET || !equalName(u.Header.Name, z.Name) {
+			continue
+		}
+		if serialLess(soa.Serial, b.Serial) {
+			soa, replaced = *b, true
+		}
+	}
+	return soa, replaced
+}
+
+// checkPrerequisites checks the prerequisite section of an update
+// against the zone, as described in RFC 2136 section 3.2.
+// z.mu must be held.
+func (z *Zone) checkPrerequisites(prereqs []dnsmessage.Resource) dnsmessage.RCode {
+	// RRsets which must exist with specific values, grouped by name and type.
+	var values [][]dnsmessage.Resource
+	for _, r := range prereqs {
+		h := r.Header
+		if !IsSubdomain(h.Name, z.Name) {
+			return RCodeNotZone
+		}
+		switch h.Class {
+		case dnsmessage.ClassANY:
+			if h.TTL != 0 || h.Length != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			if h.Type == dnsmessage.TypeALL && len(z.lookup(h.Name, h.Type)) == 0 {
+				return dnsmessage.RCodeNameError
+			} else if len(z.lookup(h.Name, h.Type)) == 0 {
+				return RCodeNXRRSet
+			}
+		case ClassNONE:
+			if h.TTL != 0 || h.Length != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			if h.Type == dnsmessage.TypeALL && len(z.lookup(h.Name, h.Type)) > 0 {
+				return RCodeYXDomain
+			} else if len(z.lookup(h.Name, h.Type)) > 0 {
+				return RCodeYXRRSet
+			}
+		case dnsmessage.ClassINET:
+			if h.TTL != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			grouped := false
+			for i, set := range values {
+				if equalName(set[0].Header.Name, h.Name) && set[0].Header.Type == h.Type {
+					values[i] = append(values[i], r)
+					grouped = true
+					break
+				}
+			}
+			if !grouped {
+				values = append(values, []dnsmessage.Resource{r})
+			}
+		default:
+			return RCodeNotZone
+		}
+	}
+	for _, set := range values {
+		rrset := z.lookup(set[0].Header.Name, set[0].Header.Type)
+		if len(difference(rrset, set)) > 0 || len(difference(set, rrset)) > 0 {
+			return RCodeNXRRSet
+		}
+	}
+	return dnsmessage.RCodeSuccess
+}
+
+// prescan checks the update section of an update for errors before
+// any changes are made, as described in RFC 2136 section 3.4.1.
+func prescan(z *Zone, updates []dnsmessage.Resource) dnsmessage.RCode {
+	for _, r := range updates {
+		h := r.Header
+		if !IsSubdomain(h.Name, z.Name) {
+			return RCodeNotZone
+		}
+		switch h.Class {
+		case dnsmessage.ClassINET:
+			if metaType(h.Type) {
+				return dnsmessage.RCodeFormatError
+			}
+		case dnsmessage.ClassANY:
+			if h.TTL != 0 || h.Length != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			if metaType(h.Type) && h.Type != dnsmessage.TypeALL {
+				return dnsmessage.RCodeFormatError
+			}
+		case ClassNONE:
+			if h.TTL != 0 || metaType(h.Type) {
+				return dnsmessage.RCodeFormatError
+			}
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+	return dnsmessage.RCodeSuccess
+}
+
+// metaType reports whether t is a query type rather than the type of
+// data held in a zone.
+func metaType(t dnsmessage.Type) bool {
+	switch t {
+	case dnsmessage.TypeALL, dnsmessage.TypeAXFR, TypeIXFR, dnsmessage.TypeOPT:
+		return true
+	}
+	return false
+}
+
+// updateResources returns a copy of rrs, the resources of the zone
+// apex, changed by the update section updates.
+func updateResources(apex dnsmessage.Name, rrs, updates []dnsmessage.Resource) []dnsmessage.Resource {
+	rrs = append([]dnsmessage.Resource(nil), rrs...)
+	for _, u := range updates {
+		h := u.Header
+		// The SOA and NS records at the apex are never removed entirely.
+		protected := func(r dnsmessage.Resource) bool {
+			return equalName(r.Header.Name, apex) && (r.Header.Type == dnsmessage.TypeSOA || r.Header.Type == dnsmessage.TypeNS)
+		}
+		switch h.Class {
+		case dnsmessage.ClassINET:
+			// the zone's SOA record is held apart; see updatedSOA.
+			if h.Type == dnsmessage.TypeSOA {
+				continue
+			}
+			// a new CNAME replaces the existing one (RFC 2136 section 3.4.2.2).
+			if i := indexCNAME(rrs, h.Name); h.Type == dnsmessage.TypeCNAME && i >= 0 {
+				rrs[i] = u
+				continue
+			}
+			if conflictsCNAME(rrs, u) {
+				continue
+			}
+			if !containsResource(rrs, u) {
+				rrs = append(rrs, u)
+			}
+		case dnsmessage.ClassANY:
+			rrs = filter(rrs, func(r dnsmessage.Resource) bool {
+				if !equalName(r.Header.Name, h.Name) || protected(r) {
+					return true
+				}
+				return h.Type != dnsmessage.TypeALL && r.Header.Type != h.Type
+			})
+		case ClassNONE:
+			if protected(u) && (h.Type == dnsmessage.TypeSOA || len(filterName(rrs, apex, dnsmessage.TypeNS)) == 1) {
+				continue
+			}
+			del := u
+			del.Header.Class = dnsmessage.ClassINET
+			rrs = filter(rrs, func(r dnsmessage.Resource) bool {
+				return !equalResource(r, del)
+			})
+		}
+	}
+	return rrs
+}
+
+// conflictsCNAME reports whether adding r to rrs would place a CNAME
+// record alongside other data with the same name.
+func conflictsCNAME(rrs []dnsmessage.Resource, r dnsmessage.Resource) bool {
+	for _, rr := range rrs {
+		if !equalName(rr.Header.Name, r.Header.Name) {
+			continue
+		}
+		isCNAME := rr.Header.Type == dnsmessage.TypeCNAME
+		if isCNAME != (r.Header.Type == dnsmessage.TypeCNAME) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexCNAME returns the index of the CNAME record named name in rrs,
+// or -1 if there is none.
+func indexCNAME(rrs []dnsmessage.Resource, name dnsmessage.Name) int {
+	for i, rr := range rrs {
+		if rr.Header.Type == dnsmessage.TypeCNAME && equalName(rr.Header.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func filter(rrs []dnsmessage.Resource, keep func(dnsmessage.Resource) bool) []dnsmessage.Resource {
+	var kept []dnsmessage.Resource
+	for _, r := range rrs {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func filterName(rrs []dnsmessage.Resource, name dnsmessage.Name, t dnsmessage.Type) []dnsmessage.Resource {
+	return filter(rrs, func(r dnsmessage.Resource) bool {
+		return equalName(r.Header.Name, name) && r.Header.Type == t
+	})
+}
+
+// difference returns the resources in a which are not in b.
+func difference(a, b []dnsmessage.Resource) []dnsmessage.Resource {
+	return filter(a, func(r dnsmessage.Resource) bool {
+		return !containsResource(b, r)
+	})
+}
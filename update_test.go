@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestUpdateMessage(t *testing.T) {
+	u := &Update{Zone: dnsmessage.MustNewName("example.test.")}
+	name := dnsmessage.MustNewName("www.example.test.")
+	u.NameInUse(name)
+	u.RRsetNotExists(name, dnsmessage.TypeAAAA)
+	u.DeleteRRset(name, dnsmessage.TypeA)
+	u.Add(testA("www.example.test.", 192, 0, 2, 10))
+	msg := u.Message()
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != OpCodeUPDATE {
+		t.Errorf("opcode %d, want %d", h.OpCode, OpCodeUPDATE)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	prereqs, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dnsmessage.ResourceHeader{
+		{Name: name, Type: dnsmessage.TypeALL, Class: dnsmessage.ClassANY},
+		{Name: name, Type: dnsmessage.TypeAAAA, Class: ClassNONE},
+	}
+	for i, r := range prereqs {
+		if r.Header != want[i] {
+			t.Errorf("prerequisite %d: got %v, want %v", i, r.Header, want[i])
+		}
+	}
+}
+
+// updateRejecter answers every update as if an RRset prerequisite failed.
+func updateRejecter(w ResponseWriter, msg *dnsmessage.Message) {
+	w.WriteMsg(dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       msg.Header.ID,
+			Response: true,
+			OpCode:   OpCodeUPDATE,
+			RCode:    RCodeNXRRSet,
+		},
+		Questions: msg.Questions,
+	})
+}
+
+func TestSendUpdate(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go ServePacket(conn, updateRejecter)
+
+	u := &Update{Zone: dnsmessage.MustNewName("example.test.")}
+	u.RRsetExistsValue(testA("www.example.test.", 192, 0, 2, 1))
+	u.Add(testA("www.example.test.", 192, 0, 2, 10))
+	err = SendUpdate(u, conn.LocalAddr().String())
+	if !errors.Is(err, ErrNXRRSet) {
+		t.Errorf("got error %v, want %v", err, ErrNXRRSet)
+	}
+	var rerr RCodeError
+	if !errors.As(err, &rerr) || dnsmessage.RCode(rerr) != RCodeNXRRSet {
+		t.Errorf("error %v is not an RCodeError", err)
+	}
+}
+
+func TestServerUpdate(t *testing.T) {
+	z := testZone()
+	z.AllowUpdate = []UpdatePolicy{
+		{Name: dnsmessage.MustNewName("dyn.example.test."), Subdomains: true},
+		{Name: dnsmessage.MustNewName("www.example.test."), Types: []dnsmessage.Type{dnsmessage.TypeA}},
+		{Name: z.Name, Types: []dnsmessage.Type{dnsmessage.TypeSOA}},
+	}
+	soaRR := func(serial uint32) dnsmessage.Resource {
+		soa := z.SOA
+		soa.Serial = serial
+		soa.Refresh = 1234
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: z.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &soa,
+		}
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv := &Server{Zones: []*Zone{z}}
+	go srv.ServePacket(conn)
+	addr := conn.LocalAddr().String()
+
+	www := dnsmessage.MustNewName("www.example.test.")
+	host := dnsmessage.MustNewName("host.dyn.example.test.")
+	var tests = []struct {
+		name   string
+		build  func(u *Update)
+		err    error
+		serial uint32
+	}{
+		{
+			"add",
+			func(u *Update) {
+				u.NameNotInUse(host)
+				u.Add(testA("host.dyn.example.test.", 192, 0, 2, 20))
+			},
+			nil, 2,
+		},
+		{
+			"name exists",
+			func(u *Update) {
+				u.NameNotInUse(host)
+				u.Add(testA("host.dyn.example.test.", 192, 0, 2, 21))
+			},
+			ErrYXDomain, 2,
+		},
+		{
+			"wrong value",
+			func(u *Update) {
+				u.RRsetExistsValue(testA("www.example.test.", 192, 0, 2, 99))
+				u.DeleteRRset(www, dnsmessage.TypeA)
+			},
+			ErrNXRRSet, 2,
+		},
+		{
+			"replace",
+			func(u *Update) {
+				u.RRsetExistsValue(testA("www.example.test.", 192, 0, 2, 1))
+				u.DeleteRRset(www, dnsmessage.TypeA)
+				u.Add(testA("www.example.test.", 192, 0, 2, 100))
+			},
+			nil, 3,
+		},
+		{
+			"not permitted",
+			func(u *Update) {
+				u.Add(testA("mail.example.test.", 192, 0, 2, 22))
+			},
+			ErrRefused, 3,
+		},
+		{
+			"not in zone",
+			func(u *Update) {
+				u.Add(testA("www.example.org.", 192, 0, 2, 22))
+			},
+			ErrNotZone, 3,
+		},
+		{
+			"delete name",
+			func(u *Update) {
+				u.NameInUse(host)
+				u.DeleteName(host)
+			},
+			nil, 4,
+		},
+		{
+			"replace soa",
+			func(u *Update) {
+				u.Add(soaRR(10))
+			},
+			nil, 10,
+		},
+		{
+			"older soa",
+			func(u *Update) {
+				u.Add(soaRR(9))
+			},
+			nil, 10,
+		},
+	}
+	for _, tt := range tests {
+		u := &Update{Zone: z.Name}
+		tt.build(u)
+		err := SendUpdate(u, addr)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if z.Serial() != tt.serial {
+			t.Errorf("%s: zone serial %d, want %d", tt.name, z.Serial(), tt.serial)
+		}
+	}
+	want := []dnsmessage.Resource{
+		testA("mail.example.test.", 192, 0, 2, 2),
+		testA("www.example.test.", 192, 0, 2, 100),
+	}
+	if len(difference(z.Resources, want)) > 0 || len(difference(want, z.Resources)) > 0 {
+		t.Errorf("zone resources %v, want %v", z.Resources, want)
+	}
+	if z.SOA.Refresh != 1234 {
+		t.Errorf("zone SOA not replaced: %+v", z.SOA)
+	}
+	if changes, ok := z.changesSince(1); !ok || len(changes) != 4 {
+		t.Errorf("journal has %d changes since serial 1, want 4", len(changes))
+	}
+}
+
+func TestUpdateCNAME(t *testing.T) {
+	apex := dnsmessage.MustNewName("example.test.")
+	cname := func(target string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("alias.example.test."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+		}
+	}
+	rrs := []dnsmessage.Resource{cname("www.example.test.")}
+	rrs = updateResources(apex, rrs, []dnsmessage.Resource{cname("mail.example.test.")})
+	if len(rrs) != 1 {
+		t.Fatalf("got %d records at alias, want 1: %v", len(rrs), rrs)
+	}
+	if got := rrs[0].Body.(*dnsmessage.CNAMEResource).CNAME.String(); got != "mail.example.test." {
+		t.Errorf("alias points to %s, want mail.example.test.", got)
+	}
+
+	// other data may not be added alongside the CNAME.
+	a := testA("alias.example.test.", 192, 0, 2, 1)
+	if rrs = updateResources(apex, rrs, []dnsmessage.Resource{a}); len(rrs) != 1 {
+		t.Errorf("A record added alongside CNAME: %v", rrs)
+	}
+}
@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A View answers requests from clients in any of Nets with Handler.
+// Views let a server give different answers to clients in different
+// networks, known as split horizon.
+type View struct {
+	Name    string
+	Nets    []*net.IPNet
+	Handler Handler
+}
+
+// Views is an ordered list of views. Requests are answered by the first
+// view whose networks contain the client's address.
+type Views []View
+
+// Match returns the first view whose networks contain ip, or nil if
+// there is none.
+func (vs Views) Match(ip net.IP) *View {
+	for i := range vs {
+		if containsIP(vs[i].Nets, ip) {
+			return &vs[i]
+		}
+	}
+	return nil
+}
+
+// Handler returns a Handler passing each request to the Handler of the
+// view matching the client, or to h if none does. As with ACL.Handler,
+// the client's address is found using the RemoteAddr method of the
+// ResponseWriter.
+func (vs Views) Handler(h Handler) Handler {
+	return func(w ResponseWriter, msg *dnsmessage.Message) {
+		if v := vs.Match(remoteIP(w)); v != nil {
+			v.Handler(w, msg)
+			return
+		}
+		h(w, msg)
+	}
+}
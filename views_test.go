@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestViews(t *testing.T) {
+	var answered string
+	answer := func(name string) Handler {
+		return func(w ResponseWriter, msg *dnsmessage.Message) {
+			answered = name
+		}
+	}
+	vs := Views{
+		{Name: "lab", Nets: []*net.IPNet{mustParseCIDR("192.168.9.0/24")}, Handler: answer("lab")},
+		{Name: "office", Nets: []*net.IPNet{mustParseCIDR("192.168.0.0/16"), mustParseCIDR("fd00::/8")}, Handler: answer("office")},
+	}
+	h := vs.Handler(answer("default"))
+	tests := map[string]string{
+		"192.168.9.1": "lab",
+		"192.168.1.1": "office",
+		"fd00::1":     "office",
+		"192.0.2.1":   "default",
+	}
+	qmsg := &dnsmessage.Message{Questions: []dnsmessage.Question{testq}}
+	for addr, want := range tests {
+		answered = ""
+		h(&aclWriter{raddr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 5353}}, qmsg)
+		if answered != want {
+			t.Errorf("%s: answered by %q, want %q", addr, answered, want)
+		}
+	}
+	answered = ""
+	h(&aclWriter{}, qmsg)
+	if answered != "default" {
+		t.Errorf("unknown client answered by %q, want default", answered)
+	}
+}
@@ -0,0 +1,314 @@
+package dns
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// journalLen is the number of changes to a Zone retained for
+// incremental zone transfers.
+const journalLen = 64
+
+// Zone is a set of resources for which a server is authoritative.
+// The SOA record is held separately from Resources.
+// A Zone must not be copied after first use.
+type Zone struct {
+	Name      dnsmessage.Name
+	SOA       dnsmessage.SOAResource
+	Resources []dnsmessage.Resource
+	// AllowUpdate lists the policies under which clients may change
+	// the zone's resources with dynamic updates (RFC 2136).
+	// If empty, all updates are refused.
+	AllowUpdate []UpdatePolicy
+
+	mu      sync.RWMutex
+	journal []change
+	// expired is set when the zone should not be served,
+	// such as a secondary zone which could not be refreshed.
+	expired   bool
+	secondary *Secondary
+	watchers  []chan struct{}
+}
+
+// change records the differences between two versions of a Zone.
+type change struct {
+	from    dnsmessage.SOAResource
+	to      dnsmessage.SOAResource
+	deleted []dnsmessage.Resource
+	added   []dnsmessage.Resource
+}
+
+// Serial returns the serial number from the zone's SOA record.
+func (z *Zone) Serial() uint32 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.SOA.Serial
+}
+
+// Change removes the resources in deleted from the zone, adds the
+// resources in added, then replaces the zone's SOA record with soa.
+// The change is recorded so that it may be sent to secondaries in an
+// incremental zone transfer (IXFR).
+func (z *Zone) Change(soa dnsmessage.SOAResource, deleted, added []dnsmessage.Resource) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.change(soa, deleted, added)
+}
+
+// change is like Change but z.mu must be held.
+func (z *Zone) change(soa dnsmessage.SOAResource, deleted, added []dnsmessage.Resource) {
+	var gone []dnsmessage.Resource
+	resources := make([]dnsmessage.Resource, 0, len(z.Resources)+len(added))
+	for _, r := range z.Resources {
+		if containsResource(deleted, r) {
+			gone = append(gone, r)
+			continue
+		}
+		resources = append(resources, r)
+	}
+	var fresh []dnsmessage.Resource
+	for _, a := range added {
+		if !containsResource(resources, a) {
+			fresh = append(fresh, a)
+			resources = append(resources, a)
+		}
+	}
+	z.Resources = resources
+	z.journal = append(z.journal, change{from: z.SOA, to: soa, deleted: gone, added: fresh})
+	if len(z.journal) > journalLen {
+		z.journal = z.journal[len(z.journal)-journalLen:]
+	}
+	z.SOA = soa
+	z.changed()
+}
+
+// watch returns a channel which receives a value after the zone changes.
+func (z *Zone) watch() <-chan struct{} {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	c := make(chan struct{}, 1)
+	z.watchers = append(z.watchers, c)
+	return c
+}
+
+// changed informs watchers of a change to the zone.
+// z.mu must be held.
+func (z *Zone) changed() {
+	for _, c := range z.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+			// watcher has yet to see the last change.
+		}
+	}
+}
+
+func containsResource(rrs []dnsmessage.Resource, res dnsmessage.Resource) bool {
+	for _, r := range rrs {
+		if equalResource(r, res) {
+			return true
+		}
+	}
+	return false
+}
+
+// changesSince returns the changes required to bring a copy of the
+// zone at serial up to date. False is returned if the journal does
+// not reach back to serial.
+func (z *Zone) changesSince(serial uint32) ([]change, bool) {
+	for i, c := range z.journal {
+		if c.from.Serial == serial {
+			return z.journal[i:], true
+		}
+	}
+	return nil, false
+}
+
+// replace replaces the entire contents of the zone, discarding the journal.
+func (z *Zone) replace(soa dnsmessage.SOAResource, resources []dnsmessage.Resource) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.SOA = soa
+	z.Resources = resources
+	z.journal = nil
+	z.changed()
+}
+
+// MaxChain is the greatest number of CNAME (or DNAME) records
+// followed when answering a query, whether from a zone or by
+// resolving.
+const MaxChain = 8
+
+// answer returns an authoritative reply to the query qmsg from the zone's data.
+// Queries for names below a delegation are answered with a referral.
+func (z *Zone) answer(qmsg *dnsmessage.Message) dnsmessage.Message {
+	q := qmsg.Questions[0]
+	rmsg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               qmsg.Header.ID,
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: qmsg.Header.RecursionDesired,
+		},
+		Questions: qmsg.Questions,
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if z.expired {
+		rmsg.Header.Authoritative = false
+		rmsg.Header.RCode = dnsmessage.RCodeServerFailure
+		return rmsg
+	}
+
+	name := q.Name
+	for i := 0; i < MaxChain; i++ {
+		if ns := z.delegation(name); len(ns) > 0 {
+			rmsg.Header.Authoritative = len(rmsg.Answers) > 0
+			rmsg.Authorities = ns
+			rmsg.Additionals = z.glue(ns)
+			return rmsg
+		}
+		if rrs := z.lookup(name, q.Type); len(rrs) > 0 {
+			rmsg.Answers = append(rmsg.Answers, rrs...)
+			return rmsg
+		}
+		cname := z.lookup(name, dnsmessage.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		rmsg.Answers = append(rmsg.Answers, cname[0])
+		name = cname[0].Body.(*dnsmessage.CNAMEResource).CNAME
+		if !IsSubdomain(name, z.Name) {
+			// the rest of the chain is for someone else to answer.
+			return rmsg
+		}
+	}
+	if len(rmsg.Answers) == 0 && !z.exists(name) {
+		rmsg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	rmsg.Authorities = []dnsmessage.Resource{z.soaResource()}
+	return rmsg
+}
+
+// lookup returns the zone's resources with the given name and type.
+func (z *Zone) lookup(name dnsmessage.Name, t dnsmessage.Type) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	if equalName(name, z.Name) && (t == dnsmessage.TypeSOA || t == dnsmessage.TypeALL) {
+		rrs = append(rrs, z.soaResource())
+	}
+	for _, r := range z.Resources {
+		if !equalName(r.Header.Name, name) {
+			continue
+		}
+		if r.Header.Type == t || t == dnsmessage.TypeALL {
+			rrs = append(rrs, r)
+		}
+	}
+	return rrs
+}
+
+// exists reports whether the zone holds any resources with name,
+// or with names below name.
+func (z *Zone) exists(name dnsmessage.Name) bool {
+	if equalName(name, z.Name) {
+		return true
+	}
+	for _, r := range z.Resources {
+		if IsSubdomain(r.Header.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation returns the NS records of the zone cut at or above name,
+// if any. The zone's own NS records at its apex are not a delegation.
+func (z *Zone) delegation(name dnsmessage.Name) []dnsmessage.Resource {
+	for n := name; !equalName(n, z.Name) && IsSubdomain(n, z.Name); n = parent(n) {
+		if ns := z.lookup(n, dnsmessage.TypeNS); len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// glue returns the address records held in the zone for the
+// nameservers in ns.
+func (z *Zone) glue(ns []dnsmessage.Resource) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	for _, r := range ns {
+		b, ok := r.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		rrs = append(rrs, z.lookup(b.NS, dnsmessage.TypeA)...)
+		rrs = append(rrs, z.lookup(b.NS, dnsmessage.TypeAAAA)...)
+	}
+	return rrs
+}
+
+// soaResource returns the zone's SOA record. It is served with the
+// zone's minimum TTL.
+func (z *Zone) soaResource() dnsmessage.Resource {
+	return soaRecord(z.Name, z.SOA)
+}
+
+func soaRecord(name dnsmessage.Name, soa dnsmessage.SOAResource) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   soa.MinTTL,
+		},
+		Body: &soa,
+	}
+}
+
+// IsSubdomain reports whether name is equal to or below parent,
+// ignoring case.
+func IsSubdomain(name, parent dnsmessage.Name) bool {
+	n := strings.ToLower(name.String())
+	p := strings.ToLower(parent.String())
+	if p == "." || n == p {
+		return true
+	}
+	return strings.HasSuffix(n, "."+p)
+}
+
+// parent returns the name with its first label removed.
+// The parent of the root is the root.
+func parent(name dnsmessage.Name) dnsmessage.Name {
+	s := name.String()
+	i := strings.Index(s, ".")
+	if i < 0 || i == len(s)-1 {
+		return dnsmessage.MustNewName(".")
+	}
+	return dnsmessage.MustNewName(s[i+1:])
+}
+
+// serialLess reports whether serial a is less than b using the serial
+// number arithmetic of RFC 1982.
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// equalName reports whether a and b are the same name, ignoring case.
+func equalName(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
+
+// equalResource reports whether a and b hold the same data.
+// TTLs are not compared.
+func equalResource(a, b dnsmessage.Resource) bool {
+	if !equalName(a.Header.Name, b.Header.Name) {
+		return false
+	}
+	if a.Header.Type != b.Header.Type || a.Header.Class != b.Header.Class {
+		return false
+	}
+	return reflect.DeepEqual(a.Body, b.Body)
+}
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestZoneAnswer(t *testing.T) {
+	z := testZone()
+	z.Resources = append(z.Resources,
+		dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("alias.example.test."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.example.test.")},
+		},
+		dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("sub.example.test."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.sub.example.test.")},
+		},
+		testA("ns.sub.example.test.", 192, 0, 2, 53),
+		testA("a.b.example.test.", 192, 0, 2, 4),
+	)
+	var tests = []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+		auth    bool
+	}{
+		{"www.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, true},
+		{"WWW.EXAMPLE.TEST.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, true},
+		{"www.example.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0, true},
+		{"alias.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 2, true},
+		{"nope.example.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0, true},
+		// empty non-terminal
+		{"b.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0, true},
+		{"example.test.", dnsmessage.TypeSOA, dnsmessage.RCodeSuccess, 1, true},
+		// referral
+		{"www.sub.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0, false},
+	}
+	for _, tt := range tests {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(tt.name), Type: tt.qtype, Class: dnsmessage.ClassINET}
+		rmsg := z.answer(&dnsmessage.Message{Questions: []dnsmessage.Question{q}})
+		if rmsg.Header.RCode != tt.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", tt.name, tt.qtype, rmsg.Header.RCode, tt.rcode)
+		}
+		if len(rmsg.Answers) != tt.answers {
+			t.Errorf("%s %s: %d answers, want %d", tt.name, tt.qtype, len(rmsg.Answers), tt.answers)
+		}
+		if rmsg.Header.Authoritative != tt.auth {
+			t.Errorf("%s %s: authoritative %v, want %v", tt.name, tt.qtype, rmsg.Header.Authoritative, tt.auth)
+		}
+	}
+}